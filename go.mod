@@ -9,6 +9,7 @@ require (
 	github.com/rglonek/diago v0.13.101
 	github.com/rglonek/logger v0.2.2
 	github.com/rs/zerolog v1.33.0
+	golang.org/x/sys v0.24.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -26,6 +27,5 @@ require (
 	github.com/pion/rtp v1.8.9 // indirect
 	github.com/satori/go.uuid v1.2.1-0.20181028125025-b2ce2384e17b // indirect
 	github.com/zaf/g711 v1.4.0 // indirect
-	golang.org/x/sys v0.24.0 // indirect
 	gopkg.in/hraban/opus.v2 v2.0.0-20230925203106-0188a62cb302 // indirect
 )
@@ -18,12 +18,132 @@ import (
 //go:embed VERSION
 var version string
 
+// commands are the subcommands, run as sip-spam-filter <command> --config <path> [options]; without a command, the spam filter is started
+var commands = map[string]func(args []string){
+	"prune":       prune,
+	"check-lists": checkLists,
+	"normalize":   normalize,
+	"merge":       merge,
+	"dedupe":      dedupe,
+	"diff":        diff,
+}
+
 func main() {
 	version = strings.Trim(version, "\n\r\t ")
 	log.Println("=-=-=-=-= SIP-SPAM-FILTER v" + version + " =-=-=-=-=")
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			log.Fatalf("Unknown command %s", os.Args[1])
+		}
+		command(os.Args[2:])
+		return
+	}
+
 	configPath := flag.String("config", "", "path to config file")
 	flag.Parse()
-	if *configPath == "" {
+	config := loadConfig(*configPath)
+
+	configYaml, err := yaml.Marshal(config)
+	if err != nil {
+		log.Fatalf("Failed to marshal config: %v", err)
+	}
+	log.Printf("Loaded config:\n%s", string(configYaml))
+
+	log := newLogger(config)
+	err = sipspamfilter.Run(config, log)
+	if err != nil {
+		log.Critical(err.Error())
+	}
+}
+
+// prune removes expired entries from the list files
+func prune(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to config file")
+	dryRun := flags.Bool("dry-run", false, "only log the expired entries, without changing the files")
+	flags.Parse(args)
+	config := loadConfig(*configPath)
+	log := newLogger(config)
+	if err := sipspamfilter.Prune(config, log, *dryRun); err != nil {
+		log.Critical(err.Error())
+	}
+}
+
+// checkLists prints the problems found in the list files, and exits with status 1 if there are any
+func checkLists(args []string) {
+	flags := flag.NewFlagSet("check-lists", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to config file")
+	flags.Parse(args)
+	config := loadConfig(*configPath)
+	problems, err := sipspamfilter.CheckLists(config, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if problems > 0 {
+		log.Fatalf("Found %d problems", problems)
+	}
+	log.Println("No problems found")
+}
+
+// normalize writes the list files with the numbers converted to E.164 format
+func normalize(args []string) {
+	flags := flag.NewFlagSet("normalize", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to config file, for the country code and numbering plan")
+	output := flags.String("output", "", "file to write to, instead of stdout")
+	flags.Parse(args)
+	config := loadConfig(*configPath)
+	log := newLogger(config)
+	if err := sipspamfilter.NormalizeLists(config, log, flags.Args(), *output); err != nil {
+		log.Critical(err.Error())
+	}
+}
+
+// merge writes the list files as a single list file, dropping duplicates
+func merge(args []string) {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	output := flags.String("output", "", "file to write to, instead of stdout")
+	flags.Parse(args)
+	log := logger.NewLogger()
+	log.MillisecondLogging(true)
+	if err := sipspamfilter.MergeLists(log, flags.Args(), *output); err != nil {
+		log.Critical(err.Error())
+	}
+}
+
+// dedupe removes duplicate entries, and blacklist entries covered by the whitelist, from the list files
+func dedupe(args []string) {
+	flags := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to config file")
+	did := flags.String("did", "", "name of the DID whose lists to deduplicate, instead of the global lists")
+	dryRun := flags.Bool("dry-run", false, "only log the duplicate entries, without changing the files")
+	flags.Parse(args)
+	config := loadConfig(*configPath)
+	log := newLogger(config)
+	if err := sipspamfilter.DedupeLists(config, log, *did, *dryRun); err != nil {
+		log.Critical(err.Error())
+	}
+}
+
+// diff prints the differences between two list files or directories, and exits with status 1 if there are any
+func diff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		log.Fatal("usage: diff <old file or directory> <new file or directory>")
+	}
+	differences, err := sipspamfilter.DiffLists([]string{flags.Arg(0)}, []string{flags.Arg(1)}, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if differences > 0 {
+		log.Fatalf("Found %d differences", differences)
+	}
+	log.Println("No differences found")
+}
+
+func loadConfig(configPath string) *sipspamfilter.SpamFilterConfig {
+	if configPath == "" {
 		log.Fatal("--config parameter is required")
 	}
 	config := &sipspamfilter.SpamFilterConfig{
@@ -34,7 +154,7 @@ func main() {
 	if err := defaults.Set(config); err != nil {
 		log.Fatalf("Failed to set defaults: %v", err)
 	}
-	configData, err := os.ReadFile(*configPath)
+	configData, err := os.ReadFile(configPath)
 	if err != nil {
 		log.Fatalf("Failed to read config file: %v", err)
 	}
@@ -44,19 +164,12 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to parse config file: %v", err)
 	}
+	return config
+}
 
-	configYaml, err := yaml.Marshal(config)
-	if err != nil {
-		log.Fatalf("Failed to marshal config: %v", err)
-	}
-	log.Printf("Loaded config:\n%s", string(configYaml))
-
+func newLogger(config *sipspamfilter.SpamFilterConfig) *logger.Logger {
 	log := logger.NewLogger()
 	log.SetLogLevel(logger.LogLevel(config.LogLevel))
 	log.MillisecondLogging(true)
-
-	err = sipspamfilter.Run(config, log)
-	if err != nil {
-		log.Critical(err.Error())
-	}
+	return log
 }
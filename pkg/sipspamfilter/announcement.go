@@ -0,0 +1,82 @@
+package sipspamfilter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rglonek/diago"
+	"github.com/rglonek/diago/audio"
+	"github.com/rglonek/diago/media"
+	"github.com/rglonek/logger"
+)
+
+// checkWavFile checks that the WAV file can be played to callers without converting it: 16 bit PCM, with the sample rate and channels of
+// the PCMU and PCMA codecs used for calls; returns the duration of the audio
+func checkWavFile(fileName string) (time.Duration, error) {
+	if filepath.Ext(fileName) != ".wav" {
+		return 0, fmt.Errorf("%s: only .wav files can be played", fileName)
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	wav := audio.NewWavReader(file)
+	if err := wav.ReadHeaders(); err != nil {
+		return 0, fmt.Errorf("%s: invalid WAV file: %v", fileName, err)
+	}
+	codec := media.CodecAudioUlaw // PCMA has the same sample rate and channels
+	switch {
+	case wav.WavAudioFormat != 1:
+		return 0, fmt.Errorf("%s: audio format %d is not supported, should be 1 (PCM)", fileName, wav.WavAudioFormat)
+	case wav.BitsPerSample != 16:
+		return 0, fmt.Errorf("%s: %d bits per sample is not supported, should be 16", fileName, wav.BitsPerSample)
+	case wav.SampleRate != codec.SampleRate:
+		return 0, fmt.Errorf("%s: sample rate %d Hz does not match the codec sample rate %d Hz", fileName, wav.SampleRate, codec.SampleRate)
+	case int(wav.NumChannels) != codec.NumChannels:
+		return 0, fmt.Errorf("%s: %d channels do not match the codec channels %d", fileName, wav.NumChannels, codec.NumChannels)
+	}
+	return time.Duration(wav.DataSize) * time.Second / time.Duration(codec.SampleRate*2), nil
+}
+
+// checkAnnouncement checks the announcement of the list set, if any
+func (s *listSet) checkAnnouncement(log *logger.Logger) error {
+	if s.spam.Announcement == "" {
+		return nil
+	}
+	duration, err := checkWavFile(s.spam.Announcement)
+	if err != nil {
+		return fmt.Errorf("%s announcement: %v", s.listName("blacklist"), err)
+	}
+	if maxDuration := s.spam.AnnouncementMaxDuration.ToDuration(); duration > maxDuration {
+		log.Warn("%s announcement %s is %s long, it is cut off after announcement_max_duration %s", s.listName("blacklist"), s.spam.Announcement, duration, maxDuration)
+	}
+	return nil
+}
+
+// playAnnouncement plays the announcement to the answered call, until it ends or maxDuration has passed
+func (cfg *spamFilter) playAnnouncement(log *logger.Logger, inDialog *diago.DialogServerSession, fileName string, maxDuration time.Duration) {
+	playback, err := inDialog.PlaybackCreate()
+	if err != nil {
+		log.Error("Playback failed: %v", err)
+		return
+	}
+	log.Debug("Playing announcement %s", fileName)
+	done := make(chan error, 1)
+	go func() {
+		_, err := playback.PlayFile(fileName)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		// the caller hanging up also ends the playback
+		if err != nil {
+			log.Warn("Announcement playback stopped: %v", err)
+		}
+	case <-time.After(maxDuration):
+		// the playback stops when the call is closed
+		log.Debug("Announcement reached the maximum duration")
+	}
+}
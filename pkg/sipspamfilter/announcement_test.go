@@ -0,0 +1,92 @@
+package sipspamfilter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rglonek/diago/audio"
+	"github.com/rglonek/logger"
+)
+
+// writeWavFile writes a silent WAV file of the given duration
+func writeWavFile(t *testing.T, fileName string, sampleRate int, channels int, duration time.Duration) {
+	t.Helper()
+	file, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	wav := audio.NewWavWriter(file)
+	wav.SampleRate, wav.NumChans = sampleRate, channels
+	if _, err := wav.Write(make([]byte, int(duration.Seconds()*float64(sampleRate))*2*channels)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wav.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnnouncement(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.wav")
+	writeWavFile(t, valid, 8000, 1, 2*time.Second)
+	if duration, err := checkWavFile(valid); err != nil || duration != 2*time.Second {
+		t.Errorf("expected a valid 2s announcement, got %s, %v", duration, err)
+	}
+
+	wideband := filepath.Join(dir, "wideband.wav")
+	writeWavFile(t, wideband, 16000, 1, time.Second)
+	stereo := filepath.Join(dir, "stereo.wav")
+	writeWavFile(t, stereo, 8000, 2, time.Second)
+	for fileName, expected := range map[string]string{
+		wideband:                           "sample rate 16000 Hz",
+		stereo:                             "2 channels",
+		filepath.Join(dir, "announce.mp3"): "only .wav files",
+	} {
+		if _, err := checkWavFile(fileName); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", fileName, expected, err)
+		}
+	}
+
+	// the announcement is checked when the lists load
+	cfg := &spamFilter{config: &SpamFilterConfig{}, log: logger.NewLogger()}
+	cfg.log.SetLogLevel(logger.CRITICAL)
+	cfg.config.Spam.Announcement = wideband
+	cfg.lists.spam = &cfg.config.Spam
+	if err := cfg.reload("startup"); err == nil {
+		t.Error("expected the reload to fail with an announcement which does not match the codec")
+	}
+
+	// announcements set per list file or entry are also checked when the lists load
+	cfg.config.Spam.Announcement = ""
+	blacklist := filepath.Join(dir, "blacklist.txt")
+	cfg.config.Spam.BlacklistPaths = []string{blacklist}
+	for content, expectError := range map[string]bool{
+		"#! announcement=" + valid + "\n+447000000001\n":    false,
+		"#! announcement=" + wideband + "\n+447000000001\n": true,
+		"+447000000001 announcement=" + stereo + "\n":       true,
+	} {
+		if err := os.WriteFile(blacklist, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.reload("test"); (err != nil) != expectError {
+			t.Errorf("%q: expected error %t, got %v", content, expectError, err)
+		}
+	}
+	if err := os.WriteFile(blacklist, []byte("#! announcement="+valid+"\n+447000000001\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.reload("test"); err != nil {
+		t.Fatal(err)
+	}
+	matches := cfg.lists.blacklistNumbers.lookup("+447000000001")
+	if len(matches) != 1 {
+		t.Fatalf("expected the number to be blacklisted, got %d matches", len(matches))
+	}
+	if action := matches[0].entry.attributes.apply(blockAction{announcement: wideband}); action.announcement != valid {
+		t.Errorf("expected the announcement of the list file, got %s", action.announcement)
+	}
+}
@@ -1,6 +1,8 @@
 package sipspamfilter
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/csv"
 	"fmt"
 	"os"
@@ -14,86 +16,168 @@ func (cfg *spamFilter) reopenAuditFiles() error {
 	defer cfg.auditFileSIGHUPLock.Unlock()
 	cfg.closeAuditFiles(false)
 	if cfg.config.AuditFiles.BlockedNumbers != "" {
-		cfg.auditBlockedNumbers, err = os.OpenFile(cfg.config.AuditFiles.BlockedNumbers, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		cfg.auditBlockedNumbers, cfg.auditBlockedNumbersCSV, err = cfg.openAuditFile(cfg.config.AuditFiles.BlockedNumbers, "blocked numbers", []string{"timestamp", "number", "blocklist_file_name", "blocklist_file_line_number", "blocklist_match", "caller_id_source", "blocklist_category", "blocklist_source", "blocklist_added", "blocklist_notes", "called_number", "did", "action", "status"})
 		if err != nil {
-			cfg.auditBlockedNumbers = nil
 			return err
 		}
-		cfg.auditBlockedNumbersCSV = csv.NewWriter(cfg.auditBlockedNumbers)
-		stat, err := cfg.auditBlockedNumbers.Stat()
-		if err == nil && stat.Size() == 0 {
-			err = writeCSV(cfg.auditBlockedNumbersCSV, []string{"timestamp", "number", "blocklist_file_name", "blocklist_file_line_number"})
-			if err != nil {
-				cfg.log.Error("Audit log: Error writing header to audit blocked numbers: %v", err)
-			}
-		}
 	}
 	if cfg.config.AuditFiles.AllowedNumbers != "" {
-		cfg.auditAllowedNumbers, err = os.OpenFile(cfg.config.AuditFiles.AllowedNumbers, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		cfg.auditAllowedNumbers, cfg.auditAllowedNumbersCSV, err = cfg.openAuditFile(cfg.config.AuditFiles.AllowedNumbers, "allowed numbers", []string{"timestamp", "number", "caller_id_source", "called_number", "did"})
 		if err != nil {
-			cfg.auditAllowedNumbers = nil
 			return err
 		}
-		cfg.auditAllowedNumbersCSV = csv.NewWriter(cfg.auditAllowedNumbers)
-		stat, err := cfg.auditAllowedNumbers.Stat()
-		if err == nil && stat.Size() == 0 {
-			err = writeCSV(cfg.auditAllowedNumbersCSV, []string{"timestamp", "number"})
-			if err != nil {
-				cfg.log.Error("Audit log: Error writing header to audit allowed numbers: %v", err)
-			}
-		}
 	}
 	if cfg.config.AuditFiles.WhitelistedNumbers != "" {
-		cfg.auditWhitelistedNumbers, err = os.OpenFile(cfg.config.AuditFiles.WhitelistedNumbers, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		cfg.auditWhitelistedNumbers, cfg.auditWhitelistedNumbersCSV, err = cfg.openAuditFile(cfg.config.AuditFiles.WhitelistedNumbers, "whitelisted numbers", []string{"timestamp", "number", "whitelist_file_name", "whitelist_file_line_number", "whitelist_match", "caller_id_source", "whitelist_category", "whitelist_source", "whitelist_added", "whitelist_notes", "called_number", "did"})
 		if err != nil {
-			cfg.auditWhitelistedNumbers = nil
 			return err
 		}
-		cfg.auditWhitelistedNumbersCSV = csv.NewWriter(cfg.auditWhitelistedNumbers)
-		stat, err := cfg.auditWhitelistedNumbers.Stat()
-		if err == nil && stat.Size() == 0 {
-			err = writeCSV(cfg.auditWhitelistedNumbersCSV, []string{"timestamp", "number", "whitelist_file_name", "whitelist_file_line_number"})
-			if err != nil {
-				cfg.log.Error("Audit log: Error writing header to audit whitelisted numbers: %v", err)
-			}
+	}
+	if cfg.config.AuditFiles.WithheldNumbers != "" {
+		cfg.auditWithheldNumbers, cfg.auditWithheldNumbersCSV, err = cfg.openAuditFile(cfg.config.AuditFiles.WithheldNumbers, "withheld numbers", []string{"timestamp", "caller_id", "reason", "action", "called_number", "did", "status"})
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.config.AuditFiles.GreylistedNumbers != "" {
+		cfg.auditGreylistedNumbers, cfg.auditGreylistedNumbersCSV, err = cfg.openAuditFile(cfg.config.AuditFiles.GreylistedNumbers, "greylisted numbers", []string{"timestamp", "number", "caller_id_source", "decision", "first_seen", "called_number", "did", "action", "status"})
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.config.AuditFiles.ChallengedNumbers != "" {
+		cfg.auditChallengedNumbers, cfg.auditChallengedNumbersCSV, err = cfg.openAuditFile(cfg.config.AuditFiles.ChallengedNumbers, "challenged numbers", []string{"timestamp", "number", "caller_id_source", "result", "digit", "pressed", "called_number", "did"})
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (cfg *spamFilter) auditLogAllowed(number string) {
+// openAuditFile opens the audit file for appending, and writes the header if the file is empty; an existing file with another header, written
+// by a version with other columns, is renamed to a .old file first, so that rows with different columns are not mixed in one file
+func (cfg *spamFilter) openAuditFile(fileName string, name string, header []string) (*os.File, *csv.Writer, error) {
+	headerLine := &bytes.Buffer{}
+	w := csv.NewWriter(headerLine)
+	w.Write(header)
+	w.Flush()
+	if existing, err := os.Open(fileName); err == nil {
+		line, _ := bufio.NewReader(existing).ReadString('\n')
+		existing.Close()
+		if line != "" && line != headerLine.String() {
+			oldFileName := fileName + ".old"
+			for i := 1; ; i++ {
+				if _, err := os.Stat(oldFileName); os.IsNotExist(err) {
+					break
+				}
+				oldFileName = fmt.Sprintf("%s.old.%d", fileName, i)
+			}
+			if err := os.Rename(fileName, oldFileName); err != nil {
+				return nil, nil, fmt.Errorf("could not rename %s with an outdated header: %v", fileName, err)
+			}
+			cfg.log.Warn("Audit log: the columns of the audit %s changed, moved %s to %s", name, fileName, oldFileName)
+		}
+	}
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileCSV := csv.NewWriter(file)
+	stat, err := file.Stat()
+	if err == nil && stat.Size() == 0 {
+		err = writeCSV(fileCSV, header)
+		if err != nil {
+			cfg.log.Error("Audit log: Error writing header to audit %s: %v", name, err)
+		}
+	}
+	return file, fileCSV, nil
+}
+
+// auditCall is the called party of a call, recorded in all audit files
+type auditCall struct {
+	called string // the called number, in E.164 format
+	did    string // the name of the DID whose lists were used, empty for the global lists
+}
+
+func (cfg *spamFilter) auditLogAllowed(call auditCall, caller callerIdentity) {
 	cfg.auditFileSIGHUPLock.RLock()
 	defer cfg.auditFileSIGHUPLock.RUnlock()
 	if cfg.auditAllowedNumbers != nil {
-		err := writeCSV(cfg.auditAllowedNumbersCSV, []string{time.Now().Format(time.RFC3339), number})
+		err := writeCSV(cfg.auditAllowedNumbersCSV, []string{time.Now().Format(time.RFC3339), caller.international, caller.source, call.called, call.did})
 		if err != nil {
 			cfg.log.Error("Audit log: Error writing to audit allowed numbers: %v", err)
 		}
 	}
 }
 
-func (cfg *spamFilter) auditLogBlocked(number string, fileName string, lineNo int) {
+func (cfg *spamFilter) auditLogBlocked(call auditCall, caller callerIdentity, match listMatch, action blockAction) {
 	cfg.auditFileSIGHUPLock.RLock()
 	defer cfg.auditFileSIGHUPLock.RUnlock()
 	if cfg.auditBlockedNumbers != nil {
-		err := writeCSV(cfg.auditBlockedNumbersCSV, []string{time.Now().Format(time.RFC3339), number, fileName, strconv.Itoa(lineNo)})
+		metadata := match.entry.attributes.entryMetadata()
+		actionName, status := action.auditFields()
+		err := writeCSV(cfg.auditBlockedNumbersCSV, []string{time.Now().Format(time.RFC3339), caller.international, match.list.fileName, strconv.Itoa(match.entry.lineNumber), match.entry.number, caller.source, metadata.category, metadata.source, metadata.added, match.entry.comment, call.called, call.did, actionName, status})
 		if err != nil {
 			cfg.log.Error("Audit log: Error writing to audit blocked numbers: %v", err)
 		}
 	}
 }
 
-func (cfg *spamFilter) auditLogWhitelisted(number string, fileName string, lineNo int) {
+func (cfg *spamFilter) auditLogWhitelisted(call auditCall, caller callerIdentity, match listMatch) {
 	cfg.auditFileSIGHUPLock.RLock()
 	defer cfg.auditFileSIGHUPLock.RUnlock()
 	if cfg.auditWhitelistedNumbers != nil {
-		err := writeCSV(cfg.auditWhitelistedNumbersCSV, []string{time.Now().Format(time.RFC3339), number, fileName, strconv.Itoa(lineNo)})
+		metadata := match.entry.attributes.entryMetadata()
+		err := writeCSV(cfg.auditWhitelistedNumbersCSV, []string{time.Now().Format(time.RFC3339), caller.international, match.list.fileName, strconv.Itoa(match.entry.lineNumber), match.entry.number, caller.source, metadata.category, metadata.source, metadata.added, match.entry.comment, call.called, call.did})
 		if err != nil {
 			cfg.log.Error("Audit log: Error writing to audit whitelisted numbers: %v", err)
 		}
 	}
 }
 
+// auditLogWithheld records the withheld_action applied to a call; blocked is how the call was blocked, nil if it was allowed
+func (cfg *spamFilter) auditLogWithheld(call auditCall, callerID string, reason string, action string, blocked *blockAction) {
+	cfg.auditFileSIGHUPLock.RLock()
+	defer cfg.auditFileSIGHUPLock.RUnlock()
+	if cfg.auditWithheldNumbers != nil {
+		status := ""
+		if blocked != nil {
+			_, status = blocked.auditFields()
+		}
+		err := writeCSV(cfg.auditWithheldNumbersCSV, []string{time.Now().Format(time.RFC3339), callerID, reason, action, call.called, call.did, status})
+		if err != nil {
+			cfg.log.Error("Audit log: Error writing to audit withheld numbers: %v", err)
+		}
+	}
+}
+
+// auditLogGreylisted records a greylist decision; action is how the call was blocked, nil if it was let through
+func (cfg *spamFilter) auditLogGreylisted(call auditCall, caller callerIdentity, decision string, firstSeen time.Time, action *blockAction) {
+	cfg.auditFileSIGHUPLock.RLock()
+	defer cfg.auditFileSIGHUPLock.RUnlock()
+	if cfg.auditGreylistedNumbers != nil {
+		actionName, status := "", ""
+		if action != nil {
+			actionName, status = action.auditFields()
+		}
+		err := writeCSV(cfg.auditGreylistedNumbersCSV, []string{time.Now().Format(time.RFC3339), caller.international, caller.source, decision, firstSeen.Format(time.RFC3339), call.called, call.did, actionName, status})
+		if err != nil {
+			cfg.log.Error("Audit log: Error writing to audit greylisted numbers: %v", err)
+		}
+	}
+}
+
+func (cfg *spamFilter) auditLogChallenged(call auditCall, caller callerIdentity, result string, digit string, pressed string) {
+	cfg.auditFileSIGHUPLock.RLock()
+	defer cfg.auditFileSIGHUPLock.RUnlock()
+	if cfg.auditChallengedNumbers != nil {
+		err := writeCSV(cfg.auditChallengedNumbersCSV, []string{time.Now().Format(time.RFC3339), caller.international, caller.source, result, digit, pressed, call.called, call.did})
+		if err != nil {
+			cfg.log.Error("Audit log: Error writing to audit challenged numbers: %v", err)
+		}
+	}
+}
+
 func (cfg *spamFilter) closeAuditFiles(lock bool) {
 	if lock {
 		cfg.auditFileSIGHUPLock.Lock()
@@ -126,6 +210,33 @@ func (cfg *spamFilter) closeAuditFiles(lock bool) {
 		cfg.auditWhitelistedNumbersCSV = nil
 		cfg.auditWhitelistedNumbers = nil
 	}
+	if cfg.auditWithheldNumbers != nil {
+		cfg.auditWithheldNumbersCSV.Flush()
+		if err := cfg.auditWithheldNumbersCSV.Error(); err != nil {
+			cfg.log.Error("Audit log: Error flushing audit withheld numbers: %v", err)
+		}
+		cfg.auditWithheldNumbers.Close()
+		cfg.auditWithheldNumbersCSV = nil
+		cfg.auditWithheldNumbers = nil
+	}
+	if cfg.auditGreylistedNumbers != nil {
+		cfg.auditGreylistedNumbersCSV.Flush()
+		if err := cfg.auditGreylistedNumbersCSV.Error(); err != nil {
+			cfg.log.Error("Audit log: Error flushing audit greylisted numbers: %v", err)
+		}
+		cfg.auditGreylistedNumbers.Close()
+		cfg.auditGreylistedNumbersCSV = nil
+		cfg.auditGreylistedNumbers = nil
+	}
+	if cfg.auditChallengedNumbers != nil {
+		cfg.auditChallengedNumbersCSV.Flush()
+		if err := cfg.auditChallengedNumbersCSV.Error(); err != nil {
+			cfg.log.Error("Audit log: Error flushing audit challenged numbers: %v", err)
+		}
+		cfg.auditChallengedNumbers.Close()
+		cfg.auditChallengedNumbersCSV = nil
+		cfg.auditChallengedNumbers = nil
+	}
 }
 
 func writeCSV(csv *csv.Writer, data []string) error {
@@ -0,0 +1,70 @@
+package sipspamfilter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rglonek/logger"
+)
+
+func TestAuditFileHeader(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "blocked.log")
+	old := "timestamp,number,blocklist_file_name,blocklist_file_line_number\n2024-01-01T00:00:00Z,+447000000001,blacklist.txt,1\n"
+	if err := os.WriteFile(fileName, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &spamFilter{config: &SpamFilterConfig{}, log: logger.NewLogger()}
+	cfg.log.SetLogLevel(logger.CRITICAL)
+	cfg.config.AuditFiles.BlockedNumbers = fileName
+	for i := 0; i < 2; i++ {
+		if err := cfg.reopenAuditFiles(); err != nil {
+			t.Fatal(err)
+		}
+		cfg.closeAuditFiles(true)
+	}
+
+	// the file with the outdated header is moved away once, and the new file only has the new header
+	data, err := os.ReadFile(fileName + ".old")
+	if err != nil || string(data) != old {
+		t.Errorf("expected the old audit file to be moved to .old, got %q, %v", data, err)
+	}
+	data, err = os.ReadFile(fileName)
+	if err != nil || !strings.HasPrefix(string(data), "timestamp,number,blocklist_file_name,") || strings.Count(string(data), "\n") != 1 {
+		t.Errorf("expected a new audit file with the current header, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(fileName + ".old.1"); err == nil {
+		t.Error("expected the audit file with the current header not to be moved")
+	}
+}
+
+func TestAuditLogWithheld(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "withheld.log")
+	cfg := &spamFilter{config: &SpamFilterConfig{}, log: logger.NewLogger()}
+	cfg.log.SetLogLevel(logger.CRITICAL)
+	cfg.config.AuditFiles.WithheldNumbers = fileName
+	if err := cfg.reopenAuditFiles(); err != nil {
+		t.Fatal(err)
+	}
+	call := auditCall{called: "+442070000000"}
+	cfg.auditLogWithheld(call, "anonymous", "anonymous", "reject", &blockAction{action: "reject", code: 486, reason: "Busy"})
+	cfg.auditLogWithheld(call, "anonymous", "anonymous", "allow", nil)
+	cfg.closeAuditFiles(true)
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || lines[0] != "timestamp,caller_id,reason,action,called_number,did,status" {
+		t.Fatalf("unexpected audit file %q", data)
+	}
+	if !strings.HasSuffix(lines[1], ",anonymous,anonymous,reject,+442070000000,,486 Busy") {
+		t.Errorf("expected the rejected call with its SIP status, got %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], ",allow,+442070000000,,") {
+		t.Errorf("expected the allowed call without a SIP status, got %q", lines[2])
+	}
+}
@@ -0,0 +1,226 @@
+package sipspamfilter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rglonek/logger"
+)
+
+const autoBlacklistSource = "auto_blacklist"
+
+// callRate counts the calls of each caller within a sliding window
+type callRate struct {
+	lock  sync.Mutex
+	calls map[string][]time.Time // by caller ID in E.164 format, oldest first
+}
+
+func newCallRate() *callRate {
+	return &callRate{calls: make(map[string][]time.Time)}
+}
+
+// callRatePruneInterval is how often the callers whose calls are all older than the window are dropped
+const callRatePruneInterval = time.Minute
+
+// add records a call of the caller and returns the number of calls of the caller within the window, including this one; calls of the
+// caller older than the window are dropped, the calls of other callers are dropped by prune
+func (r *callRate) add(callerID string, window time.Duration, now time.Time) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	calls := append(expireCalls(r.calls[callerID], window, now), now)
+	r.calls[callerID] = calls
+	return len(calls)
+}
+
+// prune drops the calls older than the window, and the callers without calls within the window
+func (r *callRate) prune(window time.Duration, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for number, calls := range r.calls {
+		if calls = expireCalls(calls, window, now); len(calls) == 0 {
+			delete(r.calls, number)
+		} else {
+			r.calls[number] = calls
+		}
+	}
+}
+
+// expireCalls returns the calls within the window; calls are oldest first
+func expireCalls(calls []time.Time, window time.Duration, now time.Time) []time.Time {
+	i := 0
+	for i < len(calls) && now.Sub(calls[i]) >= window {
+		i++
+	}
+	return calls[i:]
+}
+
+// reset forgets the calls of the caller
+func (r *callRate) reset(callerID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.calls, callerID)
+}
+
+// autoBlacklistPaths returns the blacklist paths with the auto blacklist file added
+func autoBlacklistPaths(spam *SpamFilterSpam) []string {
+	if !spam.AutoBlacklist {
+		return spam.BlacklistPaths
+	}
+	return addListPath(spam.BlacklistPaths, spam.AutoBlacklistFile)
+}
+
+// addListPath returns the paths with the generated list file added, unless it is empty, already one of the paths, or in one of the directories
+func addListPath(paths []string, fileName string) []string {
+	if fileName == "" {
+		return paths
+	}
+	if inListPath(fileName, paths) != "" {
+		return paths
+	}
+	return append(append([]string{}, paths...), fileName)
+}
+
+// inListPath returns the path the file is, or is in, empty if it is in none of the paths
+func inListPath(fileName string, paths []string) string {
+	file := absPath(fileName)
+	for _, p := range paths {
+		if isRemoteList(p) {
+			continue
+		}
+		if path := absPath(p); file == path || strings.HasPrefix(file, path+string(filepath.Separator)) {
+			return p
+		}
+	}
+	return ""
+}
+
+// absPath returns the absolute path, so that relative and absolute paths to the same file compare equal
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// createListFile checks that the generated list file is a text list file, and creates it if it does not exist
+func createListFile(fileName string) error {
+	if listFileFormat(fileName) != "" || strings.HasSuffix(fileName, ".regex") {
+		return fmt.Errorf("%s must be a text list file", fileName)
+	}
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", fileName, err)
+	}
+	return file.Close()
+}
+
+// initAutoBlacklist validates the auto blacklist settings, and creates the auto blacklist file if it does not exist
+func initAutoBlacklist(spam *SpamFilterSpam) error {
+	if !spam.AutoBlacklist {
+		return nil
+	}
+	if spam.AutoBlacklistFile == "" {
+		return fmt.Errorf("auto_blacklist_file must be set if auto_blacklist is enabled")
+	}
+	// a single call would blacklist every caller who is on no list
+	if spam.AutoBlacklistCalls < 2 {
+		return fmt.Errorf("auto_blacklist_calls must be at least 2")
+	}
+	if spam.AutoBlacklistWindow <= 0 {
+		return fmt.Errorf("auto_blacklist_window must be greater than 0")
+	}
+	if spam.AutoBlacklistTTL != "" {
+		if _, err := parseTTL(spam.AutoBlacklistTTL); err != nil {
+			return fmt.Errorf("invalid auto_blacklist_ttl: %v", err)
+		}
+	}
+	if err := createListFile(spam.AutoBlacklistFile); err != nil {
+		return fmt.Errorf("invalid auto_blacklist_file: %v", err)
+	}
+	return nil
+}
+
+// initCallRatePruning periodically drops the callers without calls within the auto blacklist window, of each list set using the auto blacklist
+func (cfg *spamFilter) initCallRatePruning() {
+	for _, set := range cfg.listSets() {
+		if set.callRate == nil {
+			continue
+		}
+		go func(rate *callRate, window time.Duration) {
+			for {
+				time.Sleep(callRatePruneInterval)
+				rate.prune(window, time.Now())
+			}
+		}(set.callRate, set.spam.AutoBlacklistWindow.ToDuration())
+	}
+}
+
+// autoBlacklist records a call of a caller which is not on any blacklist, and adds the caller to the auto blacklist file once it called
+// auto_blacklist_calls times within auto_blacklist_window; returns the new entry, or nil if the caller was not blacklisted. The entry is
+// written to the file, and the lists reloaded, in the background, so that the call is not held up; its line number is not known yet
+func (cfg *spamFilter) autoBlacklist(log *logger.Logger, lists *listSet, caller callerIdentity) *listMatch {
+	spam := lists.spam
+	now := time.Now()
+	calls := lists.callRate.add(caller.international, spam.AutoBlacklistWindow.ToDuration(), now)
+	if calls < spam.AutoBlacklistCalls {
+		log.Debug("Auto blacklist: %d calls within %s", calls, spam.AutoBlacklistWindow.ToDuration())
+		return nil
+	}
+	comment := fmt.Sprintf("auto blacklisted on %s: %d calls within %s", now.Format(time.RFC3339), calls, spam.AutoBlacklistWindow.ToDuration())
+	attributes := []string{formatAttribute("source", autoBlacklistSource), formatAttribute("added", now.Format(time.RFC3339))}
+	if spam.AutoBlacklistTTL != "" {
+		attributes = append(attributes, formatAttribute("ttl", spam.AutoBlacklistTTL))
+	}
+	lists.callRate.reset(caller.international)
+	log.Warn("Auto blacklist: adding the caller to %s, %s", spam.AutoBlacklistFile, comment)
+	line := listLine{entry: caller.international, attributes: strings.Join(attributes, " "), comment: comment}
+	cfg.generatedListWrites.Add(1)
+	go func() {
+		defer cfg.generatedListWrites.Done()
+		if err := cfg.appendListLine(spam.AutoBlacklistFile, line); err != nil {
+			log.Error("Auto blacklist: could not add the caller to %s: %v", spam.AutoBlacklistFile, err)
+			return
+		}
+		log.Debug("Auto blacklist: added the caller to %s", spam.AutoBlacklistFile)
+		cfg.requestReload("Auto blacklist")
+	}()
+
+	attrs, _ := parseEntryAttributes(line.attributes)
+	return &listMatch{
+		list:  &numberList{fileName: spam.AutoBlacklistFile},
+		entry: &number{number: caller.international, comment: comment, attributes: attrs},
+	}
+}
+
+// appendListLine appends the line to a generated list file; only the last byte of the file is read, to check that it ends with a newline
+func (cfg *spamFilter) appendListLine(fileName string, line listLine) error {
+	cfg.generatedListLock.Lock()
+	defer cfg.generatedListLock.Unlock()
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	text := line.String() + "\n"
+	if info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+			return err
+		}
+		if last[0] != '\n' {
+			text = "\n" + text
+		}
+	}
+	if _, err := file.WriteString(text); err != nil {
+		return err
+	}
+	return file.Close()
+}
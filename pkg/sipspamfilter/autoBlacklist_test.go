@@ -0,0 +1,99 @@
+package sipspamfilter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creasty/defaults"
+	"github.com/rglonek/logger"
+)
+
+func TestAutoBlacklist(t *testing.T) {
+	dir := t.TempDir()
+	blacklist := filepath.Join(dir, "blacklist.txt")
+	if err := os.WriteFile(blacklist, []byte("+447000000009"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	autoFile := filepath.Join(dir, "auto", "auto.txt")
+	if err := os.Mkdir(filepath.Dir(autoFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := &SpamFilterConfig{}
+	if err := defaults.Set(config); err != nil {
+		t.Fatal(err)
+	}
+	config.Spam.BlacklistPaths = []string{blacklist}
+	config.Spam.AutoBlacklist = true
+	config.Spam.AutoBlacklistCalls = 3
+	config.Spam.AutoBlacklistTTL = "30d"
+	config.Spam.AutoBlacklistFile = autoFile
+	cfg := &spamFilter{config: config, log: logger.NewLogger(), stats: &stats{}}
+	cfg.log.SetLogLevel(logger.CRITICAL)
+	if err := cfg.initListSets(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.reload("startup"); err != nil {
+		t.Fatal(err)
+	}
+
+	caller := callerIdentity{international: "+447000000001"}
+	for i := 0; i < 2; i++ {
+		if match := cfg.autoBlacklist(cfg.log, &cfg.lists, caller); match != nil {
+			t.Fatalf("expected call %d not to blacklist the caller", i+1)
+		}
+	}
+	match := cfg.autoBlacklist(cfg.log, &cfg.lists, caller)
+	if match == nil || match.entry.attributes.expiry().IsZero() {
+		t.Fatalf("expected the third call to blacklist the caller with an expiry, got %+v", match)
+	}
+	// the entry is written in the background
+	cfg.generatedListWrites.Wait()
+	data, err := os.ReadFile(autoFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "+447000000001 source=auto_blacklist added=") || !strings.Contains(string(data), " ttl=30d # auto blacklisted on ") {
+		t.Errorf("unexpected auto blacklist file:\n%s", data)
+	}
+
+	// the auto blacklist file is loaded with the blacklist
+	if err := cfg.reload("test"); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := cfg.isSpam(&cfg.lists, caller.international); len(matches) != 1 || matches[0].list.fileName != autoFile {
+		t.Errorf("expected the caller to be blacklisted by the auto blacklist file, got %+v", matches)
+	}
+
+	// calls outside the window are not counted
+	rate := newCallRate()
+	start := time.Now()
+	rate.add("+447000000002", time.Hour, start)
+	rate.add("+447000000002", time.Hour, start.Add(40*time.Minute))
+	if calls := rate.add("+447000000002", time.Hour, start.Add(90*time.Minute)); calls != 2 {
+		t.Errorf("expected 2 calls within the window, got %d", calls)
+	}
+	// other callers are only dropped once pruned
+	rate.add("+447000000003", time.Hour, start)
+	if calls := len(rate.calls["+447000000003"]); calls != 1 {
+		t.Errorf("expected the calls of other callers to be kept until pruned, got %d", calls)
+	}
+	rate.prune(time.Hour, start.Add(140*time.Minute))
+	if _, ok := rate.calls["+447000000003"]; ok || len(rate.calls["+447000000002"]) != 1 {
+		t.Errorf("expected the callers without calls within the window to be pruned, got %v", rate.calls)
+	}
+
+	// the auto blacklist file is not added again if it is in a blacklist directory
+	spam := SpamFilterSpam{BlacklistPaths: []string{filepath.Dir(autoFile)}, AutoBlacklist: true, AutoBlacklistFile: autoFile}
+	if paths := autoBlacklistPaths(&spam); len(paths) != 1 {
+		t.Errorf("expected the auto blacklist file not to be added, got %v", paths)
+	}
+
+	// a caller must not be blacklisted on their first call
+	spam.AutoBlacklistCalls, spam.AutoBlacklistWindow = 1, timeDuration(time.Hour)
+	if err := initAutoBlacklist(&spam); err == nil {
+		t.Error("expected auto_blacklist_calls of 1 to be rejected")
+	}
+}
@@ -2,49 +2,175 @@ package sipspamfilter
 
 import (
 	"fmt"
-	"strings"
 	"time"
 
+	"github.com/emiago/sipgo/sip"
 	"github.com/lithammer/shortuuid"
 	"github.com/rglonek/diago"
+	"github.com/rglonek/logger"
 )
 
 func (cfg *spamFilter) callHandler(inDialog *diago.DialogServerSession) {
 	log := cfg.log.WithPrefix(fmt.Sprintf("[TID=%s] ", shortuuid.New()))
-	from := inDialog.InviteRequest.From()
-	if from == nil {
-		log.Info("Incoming call: From is nil, skipping")
-		return
+	lists, called := cfg.calledListSet(inDialog.InviteRequest)
+	if lists.name != "" {
+		log = log.WithPrefix(fmt.Sprintf("[DID=%s] ", lists.name))
 	}
-	callerID := from.Address.User
-	if callerID == "" {
-		log.Info("Incoming call: Caller ID is empty, skipping")
+	log = log.WithPrefix(fmt.Sprintf("[CALLED=%s] ", called))
+	call := auditCall{called: called, did: lists.name}
+	allIdentities := cfg.callerIdentities(inDialog.InviteRequest, lists.spam.CallerIDSources)
+	identities, withheld := withheldCaller(inDialog.InviteRequest, allIdentities)
+	if len(identities) == 0 {
+		callerID := ""
+		if len(allIdentities) > 0 {
+			callerID = allIdentities[0].original
+		}
+		cfg.handleWithheld(log, inDialog, lists, call, callerID, withheld)
 		return
 	}
+	caller := identities[0]
 
-	newCallerID := cfg.convertToInternational(callerID)
-	log = log.WithPrefix(fmt.Sprintf("[OCID=%s] [CID=%s] ", callerID, newCallerID))
+	log = log.WithPrefix(fmt.Sprintf("[OCID=%s] [CID=%s] [SRC=%s] ", caller.original, caller.international, caller.source))
+	for _, identity := range identities[1:] {
+		log.Debug("Other caller ID source=%s OCID=%s CID=%s", identity.source, identity.original, identity.international)
+	}
 
-	if whitelistFile, whitelistLineNo, whitelistComment := cfg.isWhitelisted(newCallerID); whitelistFile != nil {
-		log.Info("Caller on whitelist file=%s line=%d comment=%s", *whitelistFile, whitelistLineNo, *whitelistComment)
-		cfg.auditLogWhitelisted(newCallerID, *whitelistFile, whitelistLineNo)
+	screening := cfg.screenCaller(log, lists, identities, withheld)
+	switch screening.result {
+	case screenWhitelisted:
+		for _, match := range screening.matches {
+			metadata := match.entry.attributes.entryMetadata()
+			log.Info("Caller on whitelist file=%s line=%d match=%s category=%s list_source=%s added=%s comment=%s", match.list.fileName, match.entry.lineNumber, match.entry.number, metadata.category, metadata.source, metadata.added, match.entry.comment)
+		}
+		cfg.stats.addWhitelisted()
+		cfg.auditLogWhitelisted(call, caller, screening.matches[0])
+		return
+	case screenWithheld:
+		// the caller asked for privacy, but the network still told us the number, and it is on no list
+		cfg.handleWithheld(log, inDialog, lists, call, caller.international, withheld)
+		return
+	case screenUnlisted:
+		if lists.spam.Greylist && cfg.handleGreylist(log, inDialog, lists, call, caller) {
+			return
+		}
+		if lists.spam.Challenge {
+			cfg.challengeCall(log, inDialog, lists, call, caller)
+			return
+		}
+		log.Info("Not on any blacklist, skipping")
+		cfg.stats.addAllowed()
+		cfg.auditLogAllowed(call, caller)
 		return
 	}
+	caller = screening.caller
+	blacklisted := screening.matches
 
-	var blacklistFile *string
-	var blacklistLineNo int
-	var blacklistComment *string
-	if blacklistFile, blacklistLineNo, blacklistComment = cfg.isSpam(newCallerID); blacklistFile == nil {
-		log.Info("Not on any blacklist, skipping")
-		cfg.auditLogAllowed(newCallerID)
+	for _, match := range blacklisted {
+		metadata := match.entry.attributes.entryMetadata()
+		log.Info("Caller on blacklist source=%s CID=%s file=%s line=%d match=%s category=%s list_source=%s added=%s comment=%s", caller.source, caller.international, match.list.fileName, match.entry.lineNumber, match.entry.number, metadata.category, metadata.source, metadata.added, match.entry.comment)
+	}
+
+	// the first matching entry decides how the call is blocked
+	action := blacklisted[0].entry.attributes.apply(lists.defaultBlockAction())
+	cfg.stats.addBlocked()
+	cfg.auditLogBlocked(call, caller, blacklisted[0], action)
+	cfg.blockCall(log, inDialog, action, caller.international)
+}
+
+// caller screening results, see screenCaller
+const (
+	screenWhitelisted = "whitelisted"
+	screenBlacklisted = "blacklisted"
+	screenWithheld    = "withheld" // the caller asked for privacy, and is on no list: the withheld_action applies
+	screenUnlisted    = "unlisted" // on no list: the call is greylisted, challenged or allowed
+)
+
+type callScreening struct {
+	result  string
+	caller  callerIdentity // the caller ID which matched the blacklists, otherwise the most trusted caller ID
+	matches []listMatch    // the whitelist or blacklist matches
+}
+
+// screenCaller checks the caller IDs of a call against the whitelists, then the blacklists and the auto blacklist; only the most trusted
+// caller ID is checked against the whitelist, so that a spoofed header cannot whitelist the call. A caller who asked for privacy is checked
+// the same way, so that a Privacy header cannot get a blacklisted number past the blacklists
+func (cfg *spamFilter) screenCaller(log *logger.Logger, lists *listSet, identities []callerIdentity, withheld string) callScreening {
+	caller := identities[0]
+	if whitelisted := cfg.isWhitelisted(lists, caller.international); whitelisted != nil {
+		return callScreening{result: screenWhitelisted, caller: caller, matches: whitelisted}
+	}
+
+	if !lists.spam.CheckAllCallerIDs {
+		identities = identities[:1]
+	}
+	callerIDs := []string{}
+	for _, identity := range identities {
+		callerIDs = append(callerIDs, identity.international)
+	}
+	blacklisted, blacklistedIdx := cfg.isSpam(lists, callerIDs...)
+	if blacklisted == nil && lists.spam.AutoBlacklist {
+		if match := cfg.autoBlacklist(log, lists, caller); match != nil {
+			blacklisted = []listMatch{*match}
+		}
+	}
+	switch {
+	case blacklisted != nil:
+		return callScreening{result: screenBlacklisted, caller: identities[blacklistedIdx], matches: blacklisted}
+	case withheld != "":
+		return callScreening{result: screenWithheld, caller: caller}
+	}
+	return callScreening{result: screenUnlisted, caller: caller}
+}
+
+// handleWithheld applies the withheld_action to a call with a withheld caller ID
+func (cfg *spamFilter) handleWithheld(log *logger.Logger, inDialog *diago.DialogServerSession, lists *listSet, call auditCall, callerID string, reason string) {
+	action := lists.spam.WithheldAction
+	log.Info("Caller ID withheld reason=%s action=%s", reason, action)
+	cfg.stats.addWithheld()
+	if action == "allow" {
+		cfg.auditLogWithheld(call, callerID, reason, action, nil)
 		return
 	}
+	// reject uses the reject_code and reject_reason of the block action, without answering the call
+	blocked := lists.defaultBlockAction()
+	if action == "reject" {
+		blocked.action = "reject"
+	}
+	cfg.auditLogWithheld(call, callerID, reason, action, &blocked)
+	cfg.blockCall(log, inDialog, blocked, callerID)
+}
 
-	log.Info("Caller on blacklist file=%s line=%d comment=%s", *blacklistFile, blacklistLineNo, *blacklistComment)
-	cfg.auditLogBlocked(newCallerID, *blacklistFile, blacklistLineNo)
+// handleGreylist checks a caller which is not on any list against the greylist, and blocks the call if it is greylisted;
+// returns false if the caller passed greylisting before, in which case the call is handled as an allowed call
+func (cfg *spamFilter) handleGreylist(log *logger.Logger, inDialog *diago.DialogServerSession, lists *listSet, call auditCall, caller callerIdentity) bool {
+	decision, firstSeen := cfg.greylist.check(caller.international, lists.spam, time.Now())
+	if decision == greylistKnown {
+		log.Debug("Caller passed greylisting before")
+		return false
+	}
+	log.Info("Greylist decision=%s first_seen=%s", decision, firstSeen.Format(time.RFC3339))
+	if decision != greylistBlocked {
+		cfg.stats.addAllowed()
+		cfg.auditLogGreylisted(call, caller, decision, firstSeen, nil)
+		return true
+	}
+	cfg.stats.addGreylisted()
+	action := lists.defaultBlockAction()
+	cfg.auditLogGreylisted(call, caller, decision, firstSeen, &action)
+	cfg.blockCall(log, inDialog, action, caller.international)
+	return true
+}
+
+// blockCall answers the call and hangs up after the delays, the SIT tones or the announcement of the block action, or after recording a
+// voicemail of the caller if the action is voicemail; rejects the call if the action is reject
+func (cfg *spamFilter) blockCall(log *logger.Logger, inDialog *diago.DialogServerSession, action blockAction, callerID string) {
+	if action.action == "reject" {
+		cfg.rejectCall(log, inDialog, sip.StatusCode(action.code), action.reasonPhrase())
+		return
+	}
 
 	log.Debug("Try-Sleeping")
-	time.Sleep(cfg.config.Spam.TryToAnswerDelay.ToDuration())
+	time.Sleep(action.tryToAnswerDelay)
 	log.Debug("Trying")
 	err := inDialog.Progress()
 	if err != nil {
@@ -53,7 +179,7 @@ func (cfg *spamFilter) callHandler(inDialog *diago.DialogServerSession) {
 	}
 
 	log.Debug("Answer-Sleeping")
-	time.Sleep(cfg.config.Spam.AnswerDelay.ToDuration())
+	time.Sleep(action.answerDelay)
 
 	log.Debug("Answering")
 	err = inDialog.Answer()
@@ -62,8 +188,18 @@ func (cfg *spamFilter) callHandler(inDialog *diago.DialogServerSession) {
 		return
 	}
 
-	log.Debug("Hangup-Sleeping")
-	time.Sleep(cfg.config.Spam.HangupDelay.ToDuration())
+	if action.action == "sit" {
+		cfg.playSIT(log, inDialog)
+	}
+	switch {
+	case action.action == "voicemail":
+		cfg.recordVoicemail(log, inDialog, action.voicemail, callerID)
+	case action.announcement != "":
+		cfg.playAnnouncement(log, inDialog, action.announcement, action.announcementMax)
+	case action.action != "sit":
+		log.Debug("Hangup-Sleeping")
+		time.Sleep(action.hangupDelay)
+	}
 
 	log.Debug("Dropping call")
 	inDialog.Close()
@@ -71,60 +207,56 @@ func (cfg *spamFilter) callHandler(inDialog *diago.DialogServerSession) {
 	log.Info("Done")
 }
 
-func (cfg *spamFilter) isWhitelisted(callerID string) (matchedFileName *string, matchedLineNo int, comment *string) {
+// rejectCall rejects the call with the given SIP status, without answering it
+func (cfg *spamFilter) rejectCall(log *logger.Logger, inDialog *diago.DialogServerSession, code sip.StatusCode, reason string) {
+	log.Debug("Rejecting call with %d %s", code, reason)
+	err := inDialog.Respond(code, reason, nil)
+	if err != nil {
+		log.Error("Reject failed: %v", err)
+		return
+	}
+
+	log.Info("Done")
+}
+
+// reasonPhrases are the reason phrases of the SIP status codes commonly used to reject calls
+var reasonPhrases = map[int]string{
+	404: "Not Found",
+	480: "Temporarily Unavailable",
+	486: "Busy Here",
+	600: "Busy Everywhere",
+	603: "Decline",
+	604: "Does Not Exist Anywhere",
+}
+
+func reasonPhrase(code int) string {
+	if reason, ok := reasonPhrases[code]; ok {
+		return reason
+	}
+	return "Rejected"
+}
+
+// isWhitelisted returns all entries of the whitelist of the list set matching the callerID, or nil if the number is not whitelisted
+func (cfg *spamFilter) isWhitelisted(lists *listSet, callerID string) []listMatch {
 	start := time.Now()
 	cfg.whitelistLock.RLock()
 	defer cfg.whitelistLock.RUnlock()
-	for _, whitelist := range cfg.whitelistNumbers {
-		if val, ok := whitelist.numbers[callerID]; ok {
-			fn := whitelist.fileName
-			ln := val.lineNumber
-			cm := val.comment
-			cfg.stats.addWhitelisted(time.Since(start))
-			return &fn, ln, &cm
-		}
-	}
-	return nil, 0, nil
+	matches := lists.whitelistNumbers.lookup(callerID)
+	cfg.stats.addLookup(time.Since(start))
+	return matches
 }
 
-func (cfg *spamFilter) isSpam(callerID string) (matchedFileName *string, matchedLineNo int, comment *string) {
+// isSpam returns all entries of the blacklist of the list set matching the first blacklisted callerID and the index of that callerID, or nil if no callerID is blacklisted
+func (cfg *spamFilter) isSpam(lists *listSet, callerIDs ...string) (matches []listMatch, matchedIdx int) {
 	start := time.Now()
 	cfg.blacklistLock.RLock()
 	defer cfg.blacklistLock.RUnlock()
-	for _, blacklist := range cfg.blacklistNumbers {
-		if val, ok := blacklist.numbers[callerID]; ok {
-			fn := blacklist.fileName
-			ln := val.lineNumber
-			cm := val.comment
-			cfg.stats.addBlocked(time.Since(start))
-			return &fn, ln, &cm
+	for i, callerID := range callerIDs {
+		if matches := lists.blacklistNumbers.lookup(callerID); matches != nil {
+			cfg.stats.addLookup(time.Since(start))
+			return matches, i
 		}
 	}
-	cfg.stats.addAllowed(time.Since(start))
-	return nil, 0, nil
-}
-
-func (cfg *spamFilter) convertToInternational(callerID string) string {
-	// + is good
-	if strings.HasPrefix(callerID, "+") {
-		return callerID
-	}
-
-	// 00 - replace with +
-	if strings.HasPrefix(callerID, "00") {
-		return "+" + callerID[2:]
-	}
-
-	// if it starts from country code from config, add a plus
-	if strings.HasPrefix(callerID, cfg.config.CountryCode) {
-		return "+" + callerID
-	}
-
-	// if it starts with a single zero, replace it with a +countryCode
-	if strings.HasPrefix(callerID, "0") {
-		return "+" + cfg.config.CountryCode + callerID[1:]
-	}
-
-	// all other cases, just add a + and country code
-	return "+" + cfg.config.CountryCode + callerID
+	cfg.stats.addLookup(time.Since(start))
+	return nil, 0
 }
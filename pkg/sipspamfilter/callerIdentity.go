@@ -0,0 +1,144 @@
+package sipspamfilter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// callerIdentity is a caller ID taken from one of the INVITE headers
+type callerIdentity struct {
+	source        string // one of the callerIDSources
+	original      string // the number as received
+	international string // the number converted to E.164 format
+}
+
+// callerIDSources are the supported caller ID sources, and the headers they are taken from
+var callerIDSources = map[string]string{
+	"pai":     "P-Asserted-Identity",
+	"rpid":    "Remote-Party-ID",
+	"from":    "From",
+	"contact": "Contact",
+}
+
+func validateCallerIDSources(sources []string) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("caller_id_sources must contain at least one source")
+	}
+	for _, source := range sources {
+		if _, ok := callerIDSources[source]; !ok {
+			return fmt.Errorf("invalid caller ID source %q, valid sources are pai, rpid, from and contact", source)
+		}
+	}
+	return nil
+}
+
+// callerIdentities returns the caller IDs found in the request, in the order of the caller ID sources, without duplicates
+func (cfg *spamFilter) callerIdentities(req *sip.Request, sources []string) (identities []callerIdentity) {
+	seen := make(map[string]bool)
+	for _, source := range sources {
+		for _, uri := range requestIdentityURIs(req, source) {
+			original, international := cfg.numberingPlan.uriToInternational(uri)
+			if original == "" || seen[international] {
+				continue
+			}
+			seen[international] = true
+			identities = append(identities, callerIdentity{
+				source:        source,
+				original:      original,
+				international: international,
+			})
+		}
+	}
+	return identities
+}
+
+// requestIdentityURIs returns the URIs of the given caller ID source; P-Asserted-Identity may carry both a sip: and a tel: URI
+func requestIdentityURIs(req *sip.Request, source string) (uris []sip.Uri) {
+	switch source {
+	case "from":
+		if from := req.From(); from != nil {
+			uris = append(uris, from.Address)
+		}
+	case "contact":
+		if contact := req.Contact(); contact != nil {
+			uris = append(uris, contact.Address)
+		}
+	case "pai", "rpid":
+		for _, header := range req.GetHeaders(callerIDSources[source]) {
+			for _, value := range splitHeaderValues(header.Value()) {
+				uri := sip.Uri{}
+				params := sip.NewParams()
+				if _, err := sip.ParseAddressValue(value, &uri, params); err != nil {
+					continue
+				}
+				// Remote-Party-ID may also describe the called or redirecting party
+				if party, ok := params.Get("party"); source == "rpid" && ok && !strings.EqualFold(party, "calling") {
+					continue
+				}
+				uris = append(uris, uri)
+			}
+		}
+	}
+	return uris
+}
+
+// splitHeaderValues splits a comma-separated header value, ignoring commas in quoted display names and inside <>
+func splitHeaderValues(value string) (values []string) {
+	quoted := false
+	bracketed := false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"':
+			quoted = !quoted
+		case '<':
+			bracketed = !quoted
+		case '>':
+			bracketed = false
+		case ',':
+			if !quoted && !bracketed {
+				values = append(values, strings.TrimSpace(value[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	values = append(values, strings.TrimSpace(value[start:]))
+	return values
+}
+
+// anonymousCallerIDs are the common spellings of withheld caller IDs
+var anonymousCallerIDs = map[string]bool{
+	"anonymous":   true,
+	"unknown":     true,
+	"restricted":  true,
+	"private":     true,
+	"withheld":    true,
+	"unavailable": true,
+	"blocked":     true,
+}
+
+// withheldCaller removes withheld caller IDs from the identities, and returns the reason if the caller ID is withheld:
+// empty (no caller ID), anonymous (only anonymous caller IDs) or privacy (the request contains a Privacy: id header)
+func withheldCaller(req *sip.Request, identities []callerIdentity) (numbers []callerIdentity, reason string) {
+	for _, identity := range identities {
+		if !anonymousCallerIDs[strings.ToLower(identity.original)] {
+			numbers = append(numbers, identity)
+		}
+	}
+	switch {
+	case len(identities) == 0:
+		return nil, "empty"
+	case len(numbers) == 0:
+		return nil, "anonymous"
+	}
+	for _, header := range req.GetHeaders("Privacy") {
+		for _, value := range strings.FieldsFunc(header.Value(), func(r rune) bool { return r == ';' || r == ',' || r == ' ' }) {
+			if strings.EqualFold(value, "id") {
+				return numbers, "privacy"
+			}
+		}
+	}
+	return numbers, ""
+}
@@ -0,0 +1,100 @@
+package sipspamfilter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/rglonek/logger"
+)
+
+func TestCallerIdentities(t *testing.T) {
+	msg, err := sip.ParseMessage([]byte(strings.Join([]string{
+		"INVITE sip:user@example.com SIP/2.0",
+		"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK776asdhds",
+		`From: "Display, Name" <sip:07700900001@example.com>;tag=1928301774`,
+		"To: <sip:user@example.com>",
+		"Call-ID: a84b4c76e66710",
+		"CSeq: 1 INVITE",
+		"Contact: <sip:07700900001@192.0.2.1>",
+		"P-Asserted-Identity: <sip:+447700900002@example.com>, <tel:+447700900003>",
+		"Remote-Party-ID: <sip:07700900004@example.com>;party=called",
+		"Remote-Party-ID: <sip:07700900005@example.com>;party=calling;privacy=off",
+		"Content-Length: 0",
+		"", "",
+	}, "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := newNumberingPlan("44", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &spamFilter{
+		config: &SpamFilterConfig{
+			Spam: SpamFilterSpam{
+				CallerIDSources: []string{"pai", "rpid", "from", "contact"},
+			},
+		},
+		numberingPlan: plan,
+	}
+	got := []string{}
+	for _, identity := range cfg.callerIdentities(msg.(*sip.Request), cfg.config.Spam.CallerIDSources) {
+		got = append(got, identity.source+"="+identity.international)
+	}
+	expected := "pai=+447700900002,pai=+447700900003,rpid=+447700900005,from=+447700900001"
+	if strings.Join(got, ",") != expected {
+		t.Errorf("expected %s, got %s", expected, strings.Join(got, ","))
+	}
+}
+
+func TestWithheldCaller(t *testing.T) {
+	req := sip.NewRequest(sip.INVITE, sip.Uri{User: "user", Host: "example.com"})
+	if _, reason := withheldCaller(req, nil); reason != "empty" {
+		t.Errorf("no caller ID: expected empty, got %q", reason)
+	}
+	anonymous := []callerIdentity{{source: "from", original: "Anonymous", international: "Anonymous"}}
+	if numbers, reason := withheldCaller(req, anonymous); reason != "anonymous" || numbers != nil {
+		t.Errorf("anonymous caller ID: expected anonymous, got %q", reason)
+	}
+	identities := append(anonymous, callerIdentity{source: "pai", original: "07700900001", international: "+447700900001"})
+	if numbers, reason := withheldCaller(req, identities); reason != "" || len(numbers) != 1 {
+		t.Errorf("asserted identity: expected no reason and 1 number, got %q and %d numbers", reason, len(numbers))
+	}
+	req.AppendHeader(sip.NewHeader("Privacy", "user;id"))
+	if numbers, reason := withheldCaller(req, identities); reason != "privacy" || len(numbers) != 1 {
+		t.Errorf("privacy: expected privacy and 1 number, got %q and %d numbers", reason, len(numbers))
+	}
+}
+
+func TestPrivacyBlacklisted(t *testing.T) {
+	plan, err := newNumberingPlan("44", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blacklist := &numberList{fileName: "blacklist.txt", numbers: []number{{number: "+447700900001", lineNumber: 1}}}
+	cfg := &spamFilter{
+		lists: listSet{
+			spam:             &SpamFilterSpam{CallerIDSources: []string{"pai", "from"}, WithheldAction: "allow"},
+			blacklistNumbers: newNumberIndex([]*numberList{blacklist}),
+		},
+		numberingPlan: plan,
+		stats:         &stats{},
+	}
+	log := logger.NewLogger()
+	log.SetLogLevel(logger.CRITICAL)
+	for number, expected := range map[string]string{"07700900001": screenBlacklisted, "07700900002": screenWithheld} {
+		req := sip.NewRequest(sip.INVITE, sip.Uri{User: "user", Host: "example.com"})
+		req.AppendHeader(sip.NewHeader("From", "<sip:anonymous@anonymous.invalid>;tag=1"))
+		req.AppendHeader(sip.NewHeader("P-Asserted-Identity", "<sip:"+number+"@example.com>"))
+		req.AppendHeader(sip.NewHeader("Privacy", "id"))
+		identities, withheld := withheldCaller(req, cfg.callerIdentities(req, cfg.lists.spam.CallerIDSources))
+		if withheld != "privacy" || len(identities) != 1 {
+			t.Fatalf("%s: expected a privacy-flagged caller with 1 number, got %q and %d numbers", number, withheld, len(identities))
+		}
+		// a Privacy header does not get a blacklisted number past the blacklists; the withheld_action only applies to unlisted callers
+		if screening := cfg.screenCaller(log, &cfg.lists, identities, withheld); screening.result != expected {
+			t.Errorf("%s: expected %s, got %s", number, expected, screening.result)
+		}
+	}
+}
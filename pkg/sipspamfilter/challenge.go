@@ -0,0 +1,265 @@
+package sipspamfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/rglonek/diago"
+	"github.com/rglonek/diago/media"
+	"github.com/rglonek/logger"
+)
+
+const challengeWhitelistSource = "challenge"
+
+// challenge results, as logged and recorded in the challenged numbers audit file
+const (
+	challengePassed  = "passed"  // the caller pressed the digit, and the call was transferred
+	challengeFailed  = "failed"  // the caller pressed another digit
+	challengeTimeout = "timeout" // the caller did not press a digit in time
+	challengeError   = "error"   // the prompt could not be played; the call is hung up, as the caller could not be challenged
+)
+
+var errChallengeDigit = errors.New("digit pressed")
+
+// digitListener reads the audio of an answered call in the background, so that the DTMF hook of the reader sees the digits pressed; it stops
+// at the first read error, such as the error returned by the hook, or once closed
+type digitListener struct {
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func listenDigits(r io.Reader) *digitListener {
+	l := &digitListener{stop: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(l.stopped)
+		buf := make([]byte, media.RTPBufSize)
+		for {
+			select {
+			case <-l.stop:
+				return
+			default:
+			}
+			if _, err := r.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// close stops the listener, and waits until it no longer reads the audio, so that the audio can be read by another reader; the listener only
+// notices that it must stop once its current read returns, with the next packet or once the call is closed. Returns false if done was closed
+// first, in which case the listener may still be reading
+func (l *digitListener) close(done <-chan struct{}) bool {
+	select {
+	case <-l.stop:
+	default:
+		close(l.stop)
+	}
+	select {
+	case <-l.stopped:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// challengeWhitelistPaths returns the whitelist paths with the challenge whitelist file added
+func challengeWhitelistPaths(spam *SpamFilterSpam) []string {
+	if !spam.Challenge {
+		return spam.WhitelistPaths
+	}
+	return addListPath(spam.WhitelistPaths, spam.ChallengeWhitelistFile)
+}
+
+// challengePrompts returns the prompt files in the challenge prompts directory, by the digit the prompt asks for: 0.wav to 9.wav
+func challengePrompts(dir string) (map[rune]string, error) {
+	prompts := make(map[rune]string)
+	for digit := '0'; digit <= '9'; digit++ {
+		fileName := filepath.Join(dir, string(digit)+".wav")
+		if _, err := os.Stat(fileName); err == nil {
+			prompts[digit] = fileName
+		}
+	}
+	if len(prompts) == 0 {
+		return nil, fmt.Errorf("no prompts found in %s, expected 0.wav to 9.wav", dir)
+	}
+	return prompts, nil
+}
+
+// initChallenge validates the challenge settings, and creates the challenge whitelist file if it does not exist
+func initChallenge(spam *SpamFilterSpam) error {
+	if !spam.Challenge {
+		return nil
+	}
+	if spam.Greylist {
+		return fmt.Errorf("challenge and greylist cannot both be enabled")
+	}
+	if spam.ChallengePrompts == "" || spam.ChallengeReferTo == "" {
+		return fmt.Errorf("challenge_prompts and challenge_refer_to must be set if challenge is enabled")
+	}
+	if spam.ChallengeTimeout <= 0 {
+		return fmt.Errorf("challenge_timeout must be greater than 0")
+	}
+	uri := sip.Uri{}
+	if err := sip.ParseUri(spam.ChallengeReferTo, &uri); err != nil {
+		return fmt.Errorf("invalid challenge_refer_to: %v", err)
+	}
+	if uri.Host == "" {
+		return fmt.Errorf("invalid challenge_refer_to: %s, should be a SIP URI such as sip:100@pbx.example.com", spam.ChallengeReferTo)
+	}
+	if spam.ChallengeWhitelistFile != "" {
+		if err := createListFile(spam.ChallengeWhitelistFile); err != nil {
+			return fmt.Errorf("invalid challenge_whitelist_file: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkChallengePrompts checks the challenge prompts of the list set, if the challenge is enabled
+func (s *listSet) checkChallengePrompts() error {
+	if !s.spam.Challenge {
+		return nil
+	}
+	prompts, err := challengePrompts(s.spam.ChallengePrompts)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.listName("challenge"), err)
+	}
+	for _, fileName := range prompts {
+		if _, err := checkWavFile(fileName); err != nil {
+			return fmt.Errorf("%s: %v", s.listName("challenge"), err)
+		}
+	}
+	return nil
+}
+
+// challengeCall answers the call of a caller which is not on any list, plays the prompt of a random digit, and transfers the call if the caller
+// presses that digit within the challenge timeout; otherwise the call is hung up and counted as blocked, after recording a voicemail if
+// challenge_voicemail is enabled
+func (cfg *spamFilter) challengeCall(log *logger.Logger, inDialog *diago.DialogServerSession, lists *listSet, call auditCall, caller callerIdentity) {
+	spam := lists.spam
+	prompts, err := challengePrompts(spam.ChallengePrompts)
+	if err != nil {
+		log.Error("Challenge failed: %v", err)
+		return
+	}
+	digits := []rune{}
+	for digit := range prompts {
+		digits = append(digits, digit)
+	}
+	digit := digits[rand.IntN(len(digits))]
+
+	log.Debug("Challenge: answering")
+	if err := inDialog.Answer(); err != nil {
+		log.Error("Answer failed: %v", err)
+		return
+	}
+	// closing only releases the media: the BYE is sent by Refer, or by diago once the call handler returns, and never twice as a BYE is only
+	// sent on a confirmed dialog
+	defer inDialog.Close()
+
+	// listen before playing the prompt, so that a digit pressed during the prompt is not lost; the listener stops at the first digit, or
+	// once closed so that the audio can be recorded as voicemail
+	pressed := make(chan rune, 1)
+	dtmf := inDialog.AudioReaderDTMF()
+	dtmf.OnDTMF(func(d rune) error {
+		pressed <- d
+		return errChallengeDigit
+	})
+	listener := listenDigits(dtmf)
+
+	result, answer := "", ""
+	log.Debug("Challenge: playing prompt %s", prompts[digit])
+	playback, err := inDialog.PlaybackCreate()
+	if err == nil {
+		_, err = playback.PlayFile(prompts[digit])
+	}
+	if err != nil {
+		log.Error("Challenge: prompt playback failed, hanging up: %v", err)
+		result = challengeError
+	} else {
+		select {
+		case d := <-pressed:
+			answer = string(d)
+			result = challengeFailed
+			if d == digit {
+				result = challengePassed
+			}
+		case <-time.After(spam.ChallengeTimeout.ToDuration()):
+			result = challengeTimeout
+		}
+	}
+
+	log.Info("Challenge result=%s digit=%s pressed=%s", result, string(digit), answer)
+	cfg.auditLogChallenged(call, caller, result, string(digit), answer)
+	switch result {
+	case challengePassed:
+		cfg.stats.addAllowed()
+	case challengeError:
+		cfg.stats.addBlocked()
+		cfg.stats.addChallengeError()
+	default:
+		cfg.stats.addBlocked()
+		cfg.stats.addChallenged()
+	}
+	if result != challengePassed {
+		action := blockAction{action: "hangup"}
+		if result != challengeError && spam.ChallengeVoicemail {
+			action.action = "voicemail"
+		}
+		cfg.auditLogBlocked(call, caller, challengeMatch(spam, result), action)
+		if action.action == "voicemail" {
+			// the voicemail reads the same audio, so it may only start once the listener stopped reading; if the caller sends no audio
+			// until the maximum duration, there is nothing to record
+			vm := lists.voicemail()
+			timeout, cancel := context.WithTimeout(inDialog.Context(), vm.maxDuration)
+			stopped := listener.close(timeout.Done())
+			cancel()
+			if stopped {
+				cfg.recordVoicemail(log, inDialog, vm, caller.international)
+			} else {
+				log.Info("Voicemail: the caller sent no audio, hanging up")
+			}
+		}
+		log.Info("Done")
+		return
+	}
+
+	if spam.ChallengeWhitelistFile != "" {
+		comment := fmt.Sprintf("challenge passed on %s", time.Now().Format(time.RFC3339))
+		attributes := formatAttribute("source", challengeWhitelistSource) + " " + formatAttribute("added", time.Now().Format(time.RFC3339))
+		if err := cfg.appendListLine(spam.ChallengeWhitelistFile, listLine{entry: caller.international, attributes: attributes, comment: comment}); err != nil {
+			log.Error("Challenge: could not add the caller to %s: %v", spam.ChallengeWhitelistFile, err)
+		} else {
+			log.Info("Challenge: added the caller to %s", spam.ChallengeWhitelistFile)
+			cfg.requestReload("Challenge whitelist")
+		}
+	}
+
+	referTo := sip.Uri{}
+	sip.ParseUri(spam.ChallengeReferTo, &referTo) // validated on startup
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	log.Debug("Challenge: transferring the call to %s", spam.ChallengeReferTo)
+	if err := inDialog.Refer(ctx, referTo); err != nil {
+		log.Error("Transfer failed: %v", err)
+		return
+	}
+	log.Info("Done")
+}
+
+// challengeMatch describes a failed challenge as a blacklist match, for the blocked numbers audit file: the file name is the challenge
+// prompts directory, and the comment the challenge result
+func challengeMatch(spam *SpamFilterSpam, result string) listMatch {
+	return listMatch{
+		list:  &numberList{fileName: spam.ChallengePrompts},
+		entry: &number{comment: "challenge " + result},
+	}
+}
@@ -0,0 +1,142 @@
+package sipspamfilter
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/creasty/defaults"
+	"github.com/rglonek/logger"
+)
+
+func TestChallenge(t *testing.T) {
+	dir := t.TempDir()
+	prompts := filepath.Join(dir, "prompts")
+	if err := os.Mkdir(prompts, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeWavFile(t, filepath.Join(prompts, "3.wav"), 8000, 1, time.Second)
+	writeWavFile(t, filepath.Join(prompts, "7.wav"), 8000, 1, time.Second)
+	writeWavFile(t, filepath.Join(prompts, "intro.wav"), 8000, 1, time.Second)
+
+	config := &SpamFilterConfig{}
+	if err := defaults.Set(config); err != nil {
+		t.Fatal(err)
+	}
+	whitelist := filepath.Join(dir, "challenge.txt")
+	config.Spam.Challenge = true
+	config.Spam.ChallengePrompts = prompts
+	config.Spam.ChallengeReferTo = "sip:100@pbx.example.com"
+	config.Spam.ChallengeWhitelistFile = whitelist
+	cfg := &spamFilter{config: config, log: logger.NewLogger(), stats: &stats{}}
+	cfg.log.SetLogLevel(logger.CRITICAL)
+	if err := cfg.initListSets(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(whitelist); err != nil {
+		t.Errorf("expected the challenge whitelist file to be created: %v", err)
+	}
+	if paths := cfg.lists.spam.WhitelistPaths; len(paths) != 1 || paths[0] != whitelist {
+		t.Errorf("expected the challenge whitelist file to be added to the whitelist paths, got %v", paths)
+	}
+	found, err := challengePrompts(prompts)
+	if err != nil || len(found) != 2 || found['3'] == "" || found['7'] == "" {
+		t.Errorf("expected the prompts for 3 and 7, got %v, %v", found, err)
+	}
+	if err := cfg.reload("startup"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the prompts are checked when the lists load
+	writeWavFile(t, filepath.Join(prompts, "5.wav"), 16000, 1, time.Second)
+	if err := cfg.reload("test"); err == nil {
+		t.Error("expected the reload to fail with a prompt which does not match the codec")
+	}
+
+	for name, change := range map[string]func(spam *SpamFilterSpam){
+		"greylist":      func(spam *SpamFilterSpam) { spam.Greylist = true },
+		"refer to":      func(spam *SpamFilterSpam) { spam.ChallengeReferTo = "" },
+		"invalid uri":   func(spam *SpamFilterSpam) { spam.ChallengeReferTo = "sip:" },
+		"timeout":       func(spam *SpamFilterSpam) { spam.ChallengeTimeout = 0 },
+		"csv whitelist": func(spam *SpamFilterSpam) { spam.ChallengeWhitelistFile = filepath.Join(dir, "challenge.csv") },
+	} {
+		spam := config.Spam
+		change(&spam)
+		if err := initChallenge(&spam); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// blockingReader returns one packet per read, blocking until a packet is sent; a nil packet is a digit pressed
+type blockingReader struct {
+	packets chan []byte
+	reads   atomic.Int32
+}
+
+func (r *blockingReader) Read(b []byte) (int, error) {
+	r.reads.Add(1)
+	packet, ok := <-r.packets
+	if !ok {
+		return 0, io.EOF
+	}
+	if packet == nil {
+		return 0, errChallengeDigit
+	}
+	return copy(b, packet), nil
+}
+
+func TestDigitListener(t *testing.T) {
+	packet := bytes.Repeat([]byte{0xff}, 160)
+
+	// a digit stops the listener on its own
+	r := &blockingReader{packets: make(chan []byte)}
+	l := listenDigits(r)
+	r.packets <- packet
+	r.packets <- nil
+	if !l.close(nil) {
+		t.Error("expected the listener to have stopped after the digit")
+	}
+
+	// closing waits for the current read to return, and the audio is not read after that
+	r = &blockingReader{packets: make(chan []byte)}
+	l = listenDigits(r)
+	r.packets <- packet
+	closed := make(chan bool)
+	go func() {
+		closed <- l.close(nil)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("expected close to wait for the read in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.packets <- packet
+	if !<-closed {
+		t.Fatal("expected the listener to have stopped")
+	}
+	reads := r.reads.Load()
+	select {
+	case r.packets <- packet:
+		t.Error("expected the listener not to read after it stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if r.reads.Load() != reads {
+		t.Errorf("expected %d reads, got %d", reads, r.reads.Load())
+	}
+
+	// without audio, close gives up once done is closed
+	r = &blockingReader{packets: make(chan []byte)}
+	l = listenDigits(r)
+	done := make(chan struct{})
+	close(done)
+	if l.close(done) {
+		t.Error("expected close to give up while the read is blocked")
+	}
+	close(r.packets)
+	<-l.stopped
+}
@@ -0,0 +1,488 @@
+package sipspamfilter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/rglonek/logger"
+)
+
+// compactIndex stores exact numbers as packed integers in a sorted array, with file names and comments deduplicated
+// into a string table; it can be persisted to an index file and memory-mapped on startup
+type compactIndex struct {
+	numbers       []uint64       // sorted packed numbers, one per list file entry
+	entries       []compactEntry // entry details, same order as numbers
+	stringOffsets []uint32       // string i is stringData[stringOffsets[i]:stringOffsets[i+1]]
+	stringData    []byte
+	files         []uint32 // file names, as string indexes, in numberIndex.lists order
+	others        []compactOther
+	attributes    map[uint32]*entryAttributes // the parsed attributes of the entries, by string index, so that lookups do not parse them
+	unmap         func() error
+}
+
+type compactEntry struct {
+	file       uint32
+	line       uint32
+	comment    uint32
+	attributes uint32
+}
+
+// compactOther is an entry which cannot be packed (prefix, range, regex or a number which is not all digits); these
+// are only stored in the index file, and are loaded into the regular index when the index file is loaded
+type compactOther struct {
+	file       uint32
+	line       uint32
+	entry      uint32
+	comment    uint32
+	attributes uint32
+}
+
+// errCompactIndexOutdated is returned for an index file written before the list files or the settings changed
+var errCompactIndexOutdated = errors.New("list files changed since the index file was written")
+
+const (
+	compactIndexMagic     = "SSFIDX02"
+	compactIndexByteOrder = uint32(0x01020304)
+	compactMaxDigits      = 17
+)
+
+// packNumber packs a number consisting of up to 17 digits, with an optional + prefix, into an integer
+func packNumber(n string) (packed uint64, ok bool) {
+	var plus uint64
+	if strings.HasPrefix(n, "+") {
+		plus = 1
+		n = n[1:]
+	}
+	if len(n) == 0 || len(n) > compactMaxDigits {
+		return 0, false
+	}
+	var v uint64
+	for i := 0; i < len(n); i++ {
+		if n[i] < '0' || n[i] > '9' {
+			return 0, false
+		}
+		v = v*10 + uint64(n[i]-'0')
+	}
+	// digit count is stored so that leading zeros are not lost
+	return plus<<62 | uint64(len(n))<<57 | v, true
+}
+
+func (c *compactIndex) str(i uint32) string {
+	return string(c.stringData[c.stringOffsets[i]:c.stringOffsets[i+1]])
+}
+
+func (c *compactIndex) lookup(lists []*numberList, callerID string) (matches []listMatch) {
+	packed, ok := packNumber(callerID)
+	if !ok {
+		return nil
+	}
+	i := sort.Search(len(c.numbers), func(i int) bool {
+		return c.numbers[i] >= packed
+	})
+	for ; i < len(c.numbers) && c.numbers[i] == packed; i++ {
+		e := c.entries[i]
+		matches = append(matches, listMatch{
+			list: lists[e.file],
+			entry: &number{
+				number:     callerID,
+				lineNumber: int(e.line),
+				comment:    c.str(e.comment),
+				attributes: c.attributes[e.attributes],
+			},
+		})
+	}
+	return matches
+}
+
+// expiredEntries adds the number of expired exact numbers to the counts by list file name
+func (c *compactIndex) expiredEntries(lists []*numberList, now time.Time, expired map[string]int) {
+	for _, e := range c.entries {
+		if c.attributes[e.attributes].expired(now) {
+			expired[lists[e.file].fileName]++
+		}
+	}
+}
+
+func (c *compactIndex) close() error {
+	if c.unmap == nil {
+		return nil
+	}
+	return c.unmap()
+}
+
+// compactIndexBuilder builds the compact index while list files are parsed, so that the full list does not need to be kept in memory
+type compactIndexBuilder struct {
+	index   compactIndex
+	strings map[string]uint32
+}
+
+func newCompactIndexBuilder() *compactIndexBuilder {
+	return &compactIndexBuilder{
+		index: compactIndex{
+			stringOffsets: []uint32{0},
+			attributes:    make(map[uint32]*entryAttributes),
+		},
+		strings: make(map[string]uint32),
+	}
+}
+
+func (b *compactIndexBuilder) str(s string) uint32 {
+	if i, ok := b.strings[s]; ok {
+		return i
+	}
+	i := uint32(len(b.index.stringOffsets) - 1)
+	b.index.stringData = append(b.index.stringData, s...)
+	b.index.stringOffsets = append(b.index.stringOffsets, uint32(len(b.index.stringData)))
+	b.strings[s] = i
+	return i
+}
+
+// add moves the exact numbers of a parsed list into the compact index and returns the file number; numbers which cannot be packed remain in the list
+func (b *compactIndexBuilder) add(list *numberList) (file uint32) {
+	file = uint32(len(b.index.files))
+	b.index.files = append(b.index.files, b.str(list.fileName))
+	remaining := []number{}
+	for _, n := range list.numbers {
+		packed, ok := packNumber(n.number)
+		if !ok {
+			remaining = append(remaining, n)
+			continue
+		}
+		attributes := b.str(n.attributes.String())
+		b.index.attributes[attributes] = n.attributes
+		b.index.numbers = append(b.index.numbers, packed)
+		b.index.entries = append(b.index.entries, compactEntry{
+			file:       file,
+			line:       uint32(n.lineNumber),
+			comment:    b.str(n.comment),
+			attributes: attributes,
+		})
+	}
+	// a list reused from the previous index has no packable numbers left, and may still be in use by that index
+	if len(remaining) != len(list.numbers) {
+		list.numbers = remaining
+	}
+	others := append(append([]number{}, list.numbers...), list.prefixes...)
+	for _, r := range list.ranges {
+		others = append(others, r.entry)
+	}
+	for _, r := range list.regexes {
+		others = append(others, r.entry)
+	}
+	for _, n := range others {
+		b.index.others = append(b.index.others, compactOther{
+			file:       file,
+			line:       uint32(n.lineNumber),
+			entry:      b.str(n.number),
+			comment:    b.str(n.comment),
+			attributes: b.str(n.attributes.String()),
+		})
+	}
+	return file
+}
+
+// copyEntries copies the exact numbers of unchanged list files from the previous compact index, instead of parsing the files again;
+// files maps the file numbers of the previous index to the file numbers of the new one
+func (b *compactIndexBuilder) copyEntries(previous *compactIndex, files map[uint32]uint32) {
+	for i, e := range previous.entries {
+		file, ok := files[e.file]
+		if !ok {
+			continue
+		}
+		attributes := b.str(previous.str(e.attributes))
+		b.index.attributes[attributes] = previous.attributes[e.attributes]
+		b.index.numbers = append(b.index.numbers, previous.numbers[i])
+		b.index.entries = append(b.index.entries, compactEntry{
+			file:       file,
+			line:       e.line,
+			comment:    b.str(previous.str(e.comment)),
+			attributes: attributes,
+		})
+	}
+}
+
+func (b *compactIndexBuilder) build() *compactIndex {
+	sort.Sort(compactIndexSorter{&b.index})
+	b.strings = nil
+	return &b.index
+}
+
+type compactIndexSorter struct {
+	*compactIndex
+}
+
+func (s compactIndexSorter) Len() int {
+	return len(s.numbers)
+}
+
+func (s compactIndexSorter) Less(i, j int) bool {
+	if s.numbers[i] != s.numbers[j] {
+		return s.numbers[i] < s.numbers[j]
+	}
+	return s.entries[i].file < s.entries[j].file
+}
+
+func (s compactIndexSorter) Swap(i, j int) {
+	s.numbers[i], s.numbers[j] = s.numbers[j], s.numbers[i]
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+}
+
+// listsFingerprint describes every list file (name, size and modification time), so that a persisted index file is only used if the lists did not change
+func listsFingerprint(paths []string) (string, error) {
+	fingerprint := []string{}
+	for _, path := range paths {
+		err := walkListFiles(path, func(filePath string, info os.FileInfo) error {
+			fingerprint = append(fingerprint, filePath+"\t"+strconv.FormatInt(info.Size(), 10)+"\t"+strconv.FormatInt(info.ModTime().UnixNano(), 10))
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(fingerprint, "\n"), nil
+}
+
+// indexSettings describes the settings which change how list entries are read, so that a persisted index file is only used if they did not change
+func (cfg *spamFilter) indexSettings() string {
+	numberingPlan, _ := json.Marshal(cfg.config.NumberingPlan)
+	return fmt.Sprintf("country_code=%s numbering_plan=%s strict_validation=%t", cfg.config.CountryCode, numberingPlan, cfg.config.Spam.StrictValidation)
+}
+
+// index file layout: magic, byte order marker, header counts, then each section padded to 8 bytes:
+// fingerprint, files, numbers, entries, string offsets, string data, others
+type compactIndexHeader struct {
+	byteOrder      uint32
+	_              uint32
+	fingerprintLen uint64
+	fileCount      uint64
+	numberCount    uint64
+	stringCount    uint64
+	stringDataLen  uint64
+	otherCount     uint64
+}
+
+func asBytes[T any](s []T) []byte {
+	if len(s) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(&s[0])), len(s)*int(unsafe.Sizeof(s[0])))
+}
+
+func fromBytes[T any](b []byte, count uint64) []T {
+	var t T
+	if count == 0 || uint64(len(b))/uint64(unsafe.Sizeof(t)) < count {
+		return nil
+	}
+	return unsafe.Slice((*T)(unsafe.Pointer(&b[0])), count)
+}
+
+func padding(n int) int {
+	return (8 - n%8) % 8
+}
+
+// writeFile persists the compact index to the given path, replacing the file atomically
+func (c *compactIndex) writeFile(path string, fingerprint string) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	w := bufio.NewWriter(f)
+	header := compactIndexHeader{
+		byteOrder:      compactIndexByteOrder,
+		fingerprintLen: uint64(len(fingerprint)),
+		fileCount:      uint64(len(c.files)),
+		numberCount:    uint64(len(c.numbers)),
+		stringCount:    uint64(len(c.stringOffsets) - 1),
+		stringDataLen:  uint64(len(c.stringData)),
+		otherCount:     uint64(len(c.others)),
+	}
+	sections := [][]byte{
+		[]byte(compactIndexMagic),
+		asBytes([]compactIndexHeader{header}),
+		[]byte(fingerprint),
+		asBytes(c.files),
+		asBytes(c.numbers),
+		asBytes(c.entries),
+		asBytes(c.stringOffsets),
+		c.stringData,
+		asBytes(c.others),
+	}
+	for _, section := range sections {
+		if _, err := w.Write(section); err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := w.Write(make([]byte, padding(len(section)))); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// openCompactIndexFile memory-maps an index file written by writeFile; the fingerprint must match the one the file was written with
+func openCompactIndexFile(path string, fingerprint string) (*compactIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, unmap, err := mmapFile(f, int(stat.Size()))
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseCompactIndex(data, fingerprint)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	c.unmap = unmap
+	return c, nil
+}
+
+func parseCompactIndex(data []byte, fingerprint string) (*compactIndex, error) {
+	headerSize := int(unsafe.Sizeof(compactIndexHeader{}))
+	if len(data) < len(compactIndexMagic)+headerSize || string(data[:len(compactIndexMagic)]) != compactIndexMagic {
+		return nil, fmt.Errorf("not an index file or unsupported index file version")
+	}
+	offset := len(compactIndexMagic)
+	header := fromBytes[compactIndexHeader](data[offset:], 1)[0]
+	if header.byteOrder != compactIndexByteOrder {
+		return nil, fmt.Errorf("index file was written on a machine with a different byte order")
+	}
+	offset += headerSize
+	var err error
+	// section returns the next section of count items of size bytes each; the size is checked against the rest of the file before it is
+	// computed, so that a corrupt count cannot overflow
+	section := func(count uint64, size uint64) []byte {
+		if err != nil {
+			return nil
+		}
+		if count > uint64(len(data)-offset)/size {
+			err = fmt.Errorf("index file is truncated")
+			return nil
+		}
+		n := int(count * size)
+		s := data[offset : offset+n]
+		offset = min(offset+n+padding(n), len(data))
+		return s
+	}
+	if !bytes.Equal(section(header.fingerprintLen, 1), []byte(fingerprint)) {
+		if err != nil {
+			return nil, err
+		}
+		return nil, errCompactIndexOutdated
+	}
+	if header.stringCount >= uint64(len(data)) {
+		return nil, fmt.Errorf("index file is truncated")
+	}
+	c := &compactIndex{}
+	c.files = fromBytes[uint32](section(header.fileCount, 4), header.fileCount)
+	c.numbers = fromBytes[uint64](section(header.numberCount, 8), header.numberCount)
+	c.entries = fromBytes[compactEntry](section(header.numberCount, uint64(unsafe.Sizeof(compactEntry{}))), header.numberCount)
+	c.stringOffsets = fromBytes[uint32](section(header.stringCount+1, 4), header.stringCount+1)
+	c.stringData = section(header.stringDataLen, 1)
+	c.others = fromBytes[compactOther](section(header.otherCount, uint64(unsafe.Sizeof(compactOther{}))), header.otherCount)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	// the attributes are parsed once, as few entries have distinct attributes
+	c.attributes = make(map[uint32]*entryAttributes)
+	for _, e := range c.entries {
+		if _, ok := c.attributes[e.attributes]; !ok {
+			c.attributes[e.attributes], _ = parseEntryAttributes(c.str(e.attributes))
+		}
+	}
+	return c, nil
+}
+
+// validate checks every index into the tables of an index file read from disk, and that the numbers are sorted, so that a corrupt index
+// file is rejected on load instead of failing a lookup
+func (c *compactIndex) validate() error {
+	corrupt := fmt.Errorf("index file is corrupt")
+	stringCount := uint32(len(c.stringOffsets) - 1)
+	for i := 1; i < len(c.stringOffsets); i++ {
+		if c.stringOffsets[i] < c.stringOffsets[i-1] {
+			return corrupt
+		}
+	}
+	if c.stringOffsets[0] != 0 || c.stringOffsets[stringCount] != uint32(len(c.stringData)) {
+		return corrupt
+	}
+	for _, file := range c.files {
+		if file >= stringCount {
+			return corrupt
+		}
+	}
+	fileCount := uint32(len(c.files))
+	for i, e := range c.entries {
+		if e.file >= fileCount || e.comment >= stringCount || e.attributes >= stringCount {
+			return corrupt
+		}
+		if i > 0 && c.numbers[i] < c.numbers[i-1] {
+			return corrupt
+		}
+	}
+	for _, o := range c.others {
+		if o.file >= fileCount || o.entry >= stringCount || o.comment >= stringCount || o.attributes >= stringCount {
+			return corrupt
+		}
+	}
+	return nil
+}
+
+// loadLists recreates the list files from the index file; exact numbers remain in the compact index, other entries are loaded into the lists
+func (c *compactIndex) loadLists(log *logger.Logger) ([]*numberList, error) {
+	lists := make([]*numberList, len(c.files))
+	seen := make([]map[string]int, len(c.files))
+	for i, file := range c.files {
+		lists[i] = &numberList{
+			fileName: c.str(file),
+		}
+		seen[i] = make(map[string]int)
+	}
+	problems := &listProblems{log: log} // the entries were checked when the index file was written
+	attributes := make(map[uint32]*entryAttributes)
+	for _, o := range c.others {
+		if int(o.file) >= len(lists) {
+			return nil, fmt.Errorf("index file is corrupt")
+		}
+		attrs, ok := attributes[o.attributes]
+		if !ok {
+			attrs, _ = parseEntryAttributes(c.str(o.attributes))
+			attributes[o.attributes] = attrs
+		}
+		if err := lists[o.file].addEntry(c.str(o.entry), int(o.line), c.str(o.comment), attrs, seen[o.file], problems); err != nil {
+			return nil, fmt.Errorf("error loading file %s from index file: %v", lists[o.file].fileName, err)
+		}
+	}
+	for _, list := range lists {
+		list.finish(problems)
+	}
+	return lists, nil
+}
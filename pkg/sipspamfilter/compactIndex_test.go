@@ -0,0 +1,143 @@
+package sipspamfilter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rglonek/logger"
+)
+
+func TestCompactIndexFile(t *testing.T) {
+	dir := t.TempDir()
+	listDir := filepath.Join(dir, "lists")
+	if err := os.Mkdir(listDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a.txt":   "+447000000001 action=reject # first\n+447000000002 # shared\n+44871* # prefix\n+441632960000-+441632960999\n",
+		"b.txt":   "+447000000002 # shared\nanonymous # not a number\n",
+		"c.regex": "\\+4470{10}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(listDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &spamFilter{
+		config: &SpamFilterConfig{
+			Spam: SpamFilterSpam{
+				CompactIndex: true,
+				IndexDir:     dir,
+			},
+		},
+		log: logger.NewLogger(),
+	}
+	cfg.log.SetLogLevel(logger.ERROR)
+	check := func(idx *numberIndex) {
+		t.Helper()
+		tests := map[string]int{
+			"+447000000001":  1,
+			"+447000000002":  2,
+			"+448710000000":  1,
+			"+441632960500":  1,
+			"anonymous":      1,
+			"+4470000000000": 1,
+			"+447000000003":  0,
+		}
+		for callerID, count := range tests {
+			if matches := idx.lookup(callerID); len(matches) != count {
+				t.Errorf("%s: expected %d matches, got %d", callerID, count, len(matches))
+			}
+		}
+		if matches := idx.lookup("+447000000001"); len(matches) == 1 && (matches[0].entry.comment != "first" || matches[0].entry.attributes.String() != "action=reject" || matches[0].entry.lineNumber != 1 || filepath.Base(matches[0].list.fileName) != "a.txt") {
+			t.Errorf("+447000000001: unexpected match %s:%d %s", matches[0].list.fileName, matches[0].entry.lineNumber, matches[0].entry.comment)
+		}
+	}
+
+	parsed, err := cfg.loadNumberIndex("blacklist", []string{listDir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(parsed)
+	if _, err := os.Stat(filepath.Join(dir, "blacklist.idx")); err != nil {
+		t.Fatalf("index file not written: %v", err)
+	}
+
+	loaded, err := cfg.loadNumberIndex("blacklist", []string{listDir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.close()
+	if loaded.compact.unmap == nil {
+		t.Fatal("index was not loaded from the index file")
+	}
+	check(loaded)
+
+	// the index file is not used once a setting which changes how the entries are read changed
+	cfg.config.CountryCode = "1"
+	reparsed, err := cfg.loadNumberIndex("blacklist", []string{listDir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reparsed.compact.unmap != nil {
+		t.Error("expected the index file not to be used after the country code changed")
+	}
+	check(reparsed)
+}
+
+func TestCompactIndexFileCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	listDir := filepath.Join(dir, "lists")
+	if err := os.Mkdir(listDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(listDir, "a.txt"), []byte("+447000000001 # first\n+447000000002\n+44871* # prefix\nanonymous\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &spamFilter{
+		config: &SpamFilterConfig{
+			Spam: SpamFilterSpam{
+				CompactIndex: true,
+				IndexDir:     dir,
+			},
+		},
+		log: logger.NewLogger(),
+	}
+	cfg.log.SetLogLevel(logger.ERROR)
+	indexFile := filepath.Join(dir, "blacklist.idx")
+	if _, err := cfg.loadNumberIndex("blacklist", []string{listDir}, nil); err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := map[string][]byte{
+		"empty":           {},
+		"header only":     written[:len(compactIndexMagic)+56],
+		"no tables":       written[:len(written)/2],
+		"last byte short": written[:len(written)-1],
+		// the last entry of the others table points at strings which do not exist
+		"bad string index": append(append([]byte{}, written[:len(written)-24]...), bytes.Repeat([]byte{0xff}, 24)...),
+	}
+	for name, data := range corrupted {
+		if err := os.WriteFile(indexFile, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		idx, err := cfg.loadNumberIndex("blacklist", []string{listDir}, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if idx.compact != nil && idx.compact.unmap != nil {
+			t.Errorf("%s: expected the index to be rebuilt from the list files", name)
+		}
+		for callerID, count := range map[string]int{"+447000000001": 1, "+447000000002": 1, "+448710000000": 1, "anonymous": 1, "+447000000003": 0} {
+			if matches := idx.lookup(callerID); len(matches) != count {
+				t.Errorf("%s: %s: expected %d matches, got %d", name, callerID, count, len(matches))
+			}
+		}
+		idx.close()
+	}
+}
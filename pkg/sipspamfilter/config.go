@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"time"
 	"unicode"
+
+	"gopkg.in/yaml.v3"
 )
 
 type timeDuration time.Duration
@@ -16,10 +18,7 @@ func (t *timeDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if len(s) == 0 {
 		return nil
 	}
-	if !unicode.IsLetter(rune(s[len(s)-1])) {
-		return fmt.Errorf("duration string must end with a time unit (ns, us, ms, s, m, h)")
-	}
-	d, err := time.ParseDuration(s)
+	d, err := parseTimeDuration(s)
 	if err != nil {
 		return err
 	}
@@ -27,6 +26,13 @@ func (t *timeDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+func parseTimeDuration(s string) (time.Duration, error) {
+	if len(s) == 0 || !unicode.IsLetter(rune(s[len(s)-1])) {
+		return 0, fmt.Errorf("duration string must end with a time unit (ns, us, ms, s, m, h)")
+	}
+	return time.ParseDuration(s)
+}
+
 func (t *timeDuration) ToDuration() time.Duration {
 	return time.Duration(*t)
 }
@@ -36,13 +42,22 @@ func (t timeDuration) MarshalYAML() (interface{}, error) {
 }
 
 type SpamFilterConfig struct {
-	LogLevel         int                  `json:"log_level" yaml:"log_level" default:"4"`
-	LocalAddr        string               `json:"local_addr" yaml:"local_addr" default:"0.0.0.0:0"`
-	LocalAddrInbound string               `json:"local_addr_inbound" yaml:"local_addr_inbound" default:"udp:0.0.0.0:0"`
-	CountryCode      string               `json:"country_code" yaml:"country_code" default:"44"`
-	SIP              SpamFilterSip        `json:"sip" yaml:"sip"`
-	AuditFiles       SpamFilterAuditFiles `json:"audit_files" yaml:"audit_files"`
-	Spam             SpamFilterSpam       `json:"spam" yaml:"spam"`
+	LogLevel         int                      `json:"log_level" yaml:"log_level" default:"4"`
+	LocalAddr        string                   `json:"local_addr" yaml:"local_addr" default:"0.0.0.0:0"`
+	LocalAddrInbound string                   `json:"local_addr_inbound" yaml:"local_addr_inbound" default:"udp:0.0.0.0:0"`
+	CountryCode      string                   `json:"country_code" yaml:"country_code" default:"44"`
+	NumberingPlan    *SpamFilterNumberingPlan `json:"numbering_plan" yaml:"numbering_plan"`
+	SIP              SpamFilterSip            `json:"sip" yaml:"sip"`
+	AuditFiles       SpamFilterAuditFiles     `json:"audit_files" yaml:"audit_files"`
+	Spam             SpamFilterSpam           `json:"spam" yaml:"spam"`
+	DIDs             []SpamFilterDID          `json:"dids" yaml:"dids"`
+}
+
+// SpamFilterDID has its own lists and spam settings for calls to its numbers; settings which are not set are taken from the global spam section
+type SpamFilterDID struct {
+	Name    string    `json:"name" yaml:"name"`
+	Numbers []string  `json:"numbers" yaml:"numbers"` // the called numbers, as in the user of the To header or Request-URI
+	Spam    yaml.Node `json:"spam" yaml:"spam"`       // decoded over the global spam section, see didSpamSettings
 }
 
 type SpamFilterSip struct {
@@ -55,17 +70,67 @@ type SpamFilterSip struct {
 }
 
 type SpamFilterSpam struct {
-	TryToAnswerDelay timeDuration `json:"try_to_answer_delay" yaml:"try_to_answer_delay" default:"100ms"`
-	AnswerDelay      timeDuration `json:"answer_delay" yaml:"answer_delay" default:"100ms"`
-	HangupDelay      timeDuration `json:"hangup_delay" yaml:"hangup_delay" default:"1s"`
-	BlacklistPaths   []string     `json:"blacklist_paths" yaml:"blacklist_paths"`
-	WhitelistPaths   []string     `json:"whitelist_paths" yaml:"whitelist_paths"`
+	TryToAnswerDelay        timeDuration `json:"try_to_answer_delay" yaml:"try_to_answer_delay" default:"100ms"`
+	AnswerDelay             timeDuration `json:"answer_delay" yaml:"answer_delay" default:"100ms"`
+	HangupDelay             timeDuration `json:"hangup_delay" yaml:"hangup_delay" default:"1s"`
+	BlockAction             string       `json:"block_action" yaml:"block_action" default:"hangup"`
+	RejectCode              int          `json:"reject_code" yaml:"reject_code" default:"486"`
+	RejectReason            string       `json:"reject_reason" yaml:"reject_reason"`
+	Announcement            string       `json:"announcement" yaml:"announcement"`
+	AnnouncementMaxDuration timeDuration `json:"announcement_max_duration" yaml:"announcement_max_duration" default:"30s"`
+	BlacklistPaths          []string     `json:"blacklist_paths" yaml:"blacklist_paths"`
+	WhitelistPaths          []string     `json:"whitelist_paths" yaml:"whitelist_paths"`
+	CallerIDSources         []string     `json:"caller_id_sources" yaml:"caller_id_sources" default:"[\"from\"]"`
+	CheckAllCallerIDs       bool         `json:"check_all_caller_ids" yaml:"check_all_caller_ids"`
+	WithheldAction          string       `json:"withheld_action" yaml:"withheld_action" default:"allow"`
+	CompactIndex            bool         `json:"compact_index" yaml:"compact_index"`
+	IndexDir                string       `json:"index_dir" yaml:"index_dir"`
+	AutoReload              bool         `json:"auto_reload" yaml:"auto_reload"`
+	AutoReloadDelay         timeDuration `json:"auto_reload_delay" yaml:"auto_reload_delay" default:"2s"`
+	AutoReloadPoll          bool         `json:"auto_reload_poll" yaml:"auto_reload_poll"`
+	AutoReloadPollInterval  timeDuration `json:"auto_reload_poll_interval" yaml:"auto_reload_poll_interval" default:"10s"`
+	ReloadStatusFile        string       `json:"reload_status_file" yaml:"reload_status_file"`
+	StrictValidation        bool         `json:"strict_validation" yaml:"strict_validation"`
+	RemoteListCacheDir      string       `json:"remote_list_cache_dir" yaml:"remote_list_cache_dir"`
+	RemoteListInterval      timeDuration `json:"remote_list_interval" yaml:"remote_list_interval" default:"1h"`
+	RemoteListTimeout       timeDuration `json:"remote_list_timeout" yaml:"remote_list_timeout" default:"30s"`
+	RemoteListMaxSizeMB     int64        `json:"remote_list_max_size_mb" yaml:"remote_list_max_size_mb" default:"100"`
+	Greylist                bool         `json:"greylist" yaml:"greylist"`
+	GreylistWindow          timeDuration `json:"greylist_window" yaml:"greylist_window" default:"1h"`
+	GreylistExpiry          timeDuration `json:"greylist_expiry" yaml:"greylist_expiry" default:"720h"`
+	GreylistFile            string       `json:"greylist_file" yaml:"greylist_file"`
+	AutoBlacklist           bool         `json:"auto_blacklist" yaml:"auto_blacklist"`
+	AutoBlacklistCalls      int          `json:"auto_blacklist_calls" yaml:"auto_blacklist_calls" default:"5"`
+	AutoBlacklistWindow     timeDuration `json:"auto_blacklist_window" yaml:"auto_blacklist_window" default:"1h"`
+	AutoBlacklistTTL        string       `json:"auto_blacklist_ttl" yaml:"auto_blacklist_ttl"`
+	AutoBlacklistFile       string       `json:"auto_blacklist_file" yaml:"auto_blacklist_file"`
+	Challenge               bool         `json:"challenge" yaml:"challenge"`
+	ChallengePrompts        string       `json:"challenge_prompts" yaml:"challenge_prompts"`
+	ChallengeTimeout        timeDuration `json:"challenge_timeout" yaml:"challenge_timeout" default:"10s"`
+	ChallengeReferTo        string       `json:"challenge_refer_to" yaml:"challenge_refer_to"`
+	ChallengeWhitelistFile  string       `json:"challenge_whitelist_file" yaml:"challenge_whitelist_file"`
+	ChallengeVoicemail      bool         `json:"challenge_voicemail" yaml:"challenge_voicemail"`
+	VoicemailDir            string       `json:"voicemail_dir" yaml:"voicemail_dir"`
+	VoicemailGreeting       string       `json:"voicemail_greeting" yaml:"voicemail_greeting"`
+	VoicemailMaxDuration    timeDuration `json:"voicemail_max_duration" yaml:"voicemail_max_duration" default:"60s"`
+	VoicemailRetention      string       `json:"voicemail_retention" yaml:"voicemail_retention" default:"30d"`
+}
+
+// SpamFilterNumberingPlan overrides parts of the built-in numbering plan of the country code; unset values are not overridden
+type SpamFilterNumberingPlan struct {
+	InternationalPrefixes []string `json:"international_prefixes" yaml:"international_prefixes"`
+	TrunkPrefix           *string  `json:"trunk_prefix" yaml:"trunk_prefix"`
+	KeepTrunkPrefix       *bool    `json:"keep_trunk_prefix" yaml:"keep_trunk_prefix"`
+	NationalLengths       []int    `json:"national_lengths" yaml:"national_lengths"`
 }
 
 type SpamFilterAuditFiles struct {
 	BlockedNumbers     string `json:"blocked_numbers" yaml:"blocked_numbers"`
 	AllowedNumbers     string `json:"allowed_numbers" yaml:"allowed_numbers"`
 	WhitelistedNumbers string `json:"whitelisted_numbers" yaml:"whitelisted_numbers"`
+	WithheldNumbers    string `json:"withheld_numbers" yaml:"withheld_numbers"`
+	GreylistedNumbers  string `json:"greylisted_numbers" yaml:"greylisted_numbers"`
+	ChallengedNumbers  string `json:"challenged_numbers" yaml:"challenged_numbers"`
 }
 
 type password string
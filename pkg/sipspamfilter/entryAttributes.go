@@ -0,0 +1,318 @@
+package sipspamfilter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entryAttributes are the optional key=value attributes of a list entry, or the file defaults set in a "#!" header line
+type entryAttributes struct {
+	raw              string // the attributes as written, with the file defaults first
+	action           string
+	code             int
+	reason           string
+	announcement     string // checked when the list file is parsed, see parseListFile
+	tryToAnswerDelay *time.Duration
+	answerDelay      *time.Duration
+	hangupDelay      *time.Duration
+	added            time.Time
+	ttl              time.Duration
+	expires          time.Time
+	metadata         entryMetadata
+}
+
+// entryMetadata describes where a list entry comes from; it is logged and recorded in the audit files
+type entryMetadata struct {
+	category string
+	source   string
+	added    string // as written in the list file
+}
+
+// blockAction is what happens to a blocked call: the configured defaults, overridden by the attributes of the matched entry
+type blockAction struct {
+	action           string // hangup (answer, then hang up), reject, sit (answer, play the SIT tones, then hang up), or voicemail (answer, then record the caller)
+	code             int    // SIP status code to reject with
+	reason           string // reason phrase to reject with, empty for the standard reason phrase of the code
+	tryToAnswerDelay time.Duration
+	answerDelay      time.Duration
+	hangupDelay      time.Duration
+	announcement     string        // WAV file played instead of waiting for the hangup delay, or after the SIT tones; empty for silence
+	announcementMax  time.Duration // the call is hung up after this time, even if the announcement did not end
+	voicemail        voicemailSettings
+}
+
+const fileDefaultsPrefix = "#!"
+
+// parseEntryAttributes parses space-separated key=value attributes, later attributes overriding earlier ones; invalid attributes are ignored and returned as warnings
+//
+// Values containing spaces must be quoted, for example source="customer report".
+func parseEntryAttributes(raw string) (attrs *entryAttributes, warnings []string) {
+	attrs = &entryAttributes{}
+	valid := []string{}
+	for _, attr := range splitAttributes(raw) {
+		if err := attrs.set(attr); err != nil {
+			warnings = append(warnings, fmt.Sprintf("ignoring attribute %s: %v", attr, err))
+			continue
+		}
+		valid = append(valid, attr)
+	}
+	if len(valid) == 0 {
+		return nil, warnings
+	}
+	attrs.raw = strings.Join(valid, " ")
+	return attrs, warnings
+}
+
+// isEntryAttributes returns true if the text consists of key=value attributes only; the words at the end of a list file line are only
+// taken as attributes if they do
+func isEntryAttributes(text string) bool {
+	for _, attr := range splitAttributes(text) {
+		if key, _, ok := strings.Cut(attr, "="); !ok || key == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// splitAttributes splits the attributes on spaces, keeping quoted values together
+func splitAttributes(raw string) (attrs []string) {
+	for _, span := range attributeSpans(raw) {
+		attrs = append(attrs, raw[span[0]:span[1]])
+	}
+	return attrs
+}
+
+// attributeSpans returns the start and end offsets of the space separated words of raw, keeping quoted values together
+func attributeSpans(raw string) (spans [][2]int) {
+	quoted := false
+	start := -1
+	for i := 0; i < len(raw); i++ {
+		switch {
+		case quoted && raw[i] == '\\':
+			i++
+		case raw[i] == '"':
+			quoted = !quoted
+		case !quoted && (raw[i] == ' ' || raw[i] == '\t'):
+			if start >= 0 {
+				spans = append(spans, [2]int{start, i})
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(raw)})
+	}
+	return spans
+}
+
+// formatAttribute returns the key=value attribute, quoting the value if needed
+func formatAttribute(key string, value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\"\\") {
+		value = strconv.Quote(value)
+	}
+	return key + "=" + value
+}
+
+func (a *entryAttributes) set(attr string) error {
+	key, value, ok := strings.Cut(attr, "=")
+	if strings.HasPrefix(value, "\"") {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return fmt.Errorf("invalid quoted value")
+		}
+		value = unquoted
+	}
+	if !ok || value == "" {
+		return fmt.Errorf("attributes must be in the format key=value")
+	}
+	switch key {
+	case "action":
+		switch value {
+		case "hangup", "reject", "sit", "voicemail":
+			a.action = value
+		default:
+			return fmt.Errorf("action must be one of hangup, reject, sit, voicemail")
+		}
+	case "added", "expires":
+		t, err := parseEntryDate(value, key == "expires")
+		if err != nil {
+			return err
+		}
+		if key == "added" {
+			a.added = t
+			a.metadata.added = value
+		} else {
+			a.expires = t
+		}
+	case "category":
+		a.metadata.category = value
+	case "source":
+		a.metadata.source = value
+	case "ttl":
+		ttl, err := parseTTL(value)
+		if err != nil {
+			return err
+		}
+		a.ttl = ttl
+	case "code":
+		code, err := strconv.Atoi(value)
+		if err != nil || code < 400 || code > 699 {
+			return fmt.Errorf("code must be a SIP status code between 400 and 699")
+		}
+		a.code = code
+	case "reason":
+		a.reason = value
+	case "announcement":
+		a.announcement = value
+	case "try_to_answer_delay", "answer_delay", "hangup_delay":
+		d, err := parseTimeDuration(value)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "try_to_answer_delay":
+			a.tryToAnswerDelay = &d
+		case "answer_delay":
+			a.answerDelay = &d
+		case "hangup_delay":
+			a.hangupDelay = &d
+		}
+	default:
+		return fmt.Errorf("unknown attribute")
+	}
+	return nil
+}
+
+// parseEntryDate parses a date (2006-01-02, in local time) or a timestamp (RFC3339); an expiry date is the end of that day
+func parseEntryDate(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("dates must be in the format YYYY-MM-DD or RFC3339")
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// parseTTL parses a time to live, either a duration or a number of days (for example 90d)
+func parseTTL(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("ttl must be a positive number of days (for example 90d) or a duration (for example 12h)")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := parseTimeDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("ttl must be a positive number of days (for example 90d) or a duration (for example 12h)")
+	}
+	return d, nil
+}
+
+// expiry returns when the entry expires: the expires date if set, otherwise the added date plus the ttl; zero if the entry does not expire
+func (a *entryAttributes) expiry() time.Time {
+	switch {
+	case a == nil:
+		return time.Time{}
+	case !a.expires.IsZero():
+		return a.expires
+	case !a.added.IsZero() && a.ttl > 0:
+		return a.added.Add(a.ttl)
+	}
+	return time.Time{}
+}
+
+// expired returns true if the entry has expired at the given time
+func (a *entryAttributes) expired(now time.Time) bool {
+	expiry := a.expiry()
+	return !expiry.IsZero() && !now.Before(expiry)
+}
+
+// entryMetadata returns the metadata of the entry, empty if not set
+func (a *entryAttributes) entryMetadata() entryMetadata {
+	if a == nil {
+		return entryMetadata{}
+	}
+	return a.metadata
+}
+
+// String returns the attributes as written in the list file, or an empty string if there are none
+func (a *entryAttributes) String() string {
+	if a == nil {
+		return ""
+	}
+	return a.raw
+}
+
+// apply overrides the block action with the attributes which are set
+func (a *entryAttributes) apply(action blockAction) blockAction {
+	if a == nil {
+		return action
+	}
+	if a.action != "" {
+		action.action = a.action
+	}
+	if a.code != 0 {
+		// the configured reason phrase is for the configured code
+		action.code = a.code
+		action.reason = ""
+	}
+	if a.reason != "" {
+		action.reason = a.reason
+	}
+	if a.announcement != "" {
+		action.announcement = a.announcement
+	}
+	if a.tryToAnswerDelay != nil {
+		action.tryToAnswerDelay = *a.tryToAnswerDelay
+	}
+	if a.answerDelay != nil {
+		action.answerDelay = *a.answerDelay
+	}
+	if a.hangupDelay != nil {
+		action.hangupDelay = *a.hangupDelay
+	}
+	return action
+}
+
+// defaultBlockAction returns the block action from the spam settings of the list set
+func (s *listSet) defaultBlockAction() blockAction {
+	return blockAction{
+		action:           s.spam.BlockAction,
+		code:             s.spam.RejectCode,
+		reason:           s.spam.RejectReason,
+		tryToAnswerDelay: s.spam.TryToAnswerDelay.ToDuration(),
+		answerDelay:      s.spam.AnswerDelay.ToDuration(),
+		hangupDelay:      s.spam.HangupDelay.ToDuration(),
+		announcement:     s.spam.Announcement,
+		announcementMax:  s.spam.AnnouncementMaxDuration.ToDuration(),
+		voicemail:        s.voicemail(),
+	}
+}
+
+// reasonPhrase returns the reason phrase to reject the call with
+func (a blockAction) reasonPhrase() string {
+	if a.reason != "" {
+		return a.reason
+	}
+	return reasonPhrase(a.code)
+}
+
+// auditFields returns the action and, for rejected calls, the SIP status, as recorded in the audit files
+func (a blockAction) auditFields() (action string, status string) {
+	if a.action == "reject" {
+		return a.action, fmt.Sprintf("%d %s", a.code, a.reasonPhrase())
+	}
+	return a.action, ""
+}
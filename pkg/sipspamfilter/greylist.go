@@ -0,0 +1,146 @@
+package sipspamfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// greylist remembers the callers which are not on any list: the first call of a caller is treated as spam, and a call back within the greylist window is let through
+type greylist struct {
+	lock      sync.Mutex
+	writeLock sync.Mutex                // held while the file is written, so that an older snapshot never replaces a newer one
+	fileName  string                    // the file the greylist is stored in, empty if it is only kept in memory
+	entries   map[string]*greylistEntry // by caller ID in E.164 format
+	dirty     bool                      // the entries changed since the file was last written
+}
+
+// greylistWriteInterval is how often expired entries are dropped, and the greylist file is written if the greylist changed; calls do not
+// wait for the file to be written
+const greylistWriteInterval = 10 * time.Second
+
+type greylistEntry struct {
+	FirstSeen time.Time `json:"first_seen"`
+	Passed    bool      `json:"passed"`  // the caller called back within the window
+	Expires   time.Time `json:"expires"` // the end of the window, or of greylist_expiry once the caller passed
+}
+
+// greylist decisions, as logged and recorded in the greylisted numbers audit file
+const (
+	greylistBlocked = "greylisted" // first call, or the previous call was too long ago: treated as spam
+	greylistPassed  = "passed"     // call back within the window: let through
+	greylistKnown   = "known"      // the caller passed before, and is let through until the entry expires
+)
+
+// initGreylist loads the greylist file, if any list set uses greylisting
+func (cfg *spamFilter) initGreylist() error {
+	enabled := false
+	for _, set := range cfg.listSets() {
+		enabled = enabled || set.spam.Greylist
+	}
+	if !enabled {
+		return nil
+	}
+	g, err := loadGreylist(cfg.config.Spam.GreylistFile)
+	if err != nil {
+		return fmt.Errorf("error loading greylist file %s: %v", cfg.config.Spam.GreylistFile, err)
+	}
+	if g.fileName == "" {
+		cfg.log.Warn("greylist_file is not set, the greylist is lost on restart")
+	}
+	cfg.log.Info("Greylist loaded, %d entries", len(g.entries))
+	cfg.greylist = g
+	go func() {
+		for {
+			time.Sleep(greylistWriteInterval)
+			g.prune(time.Now())
+			if err := g.write(); err != nil {
+				cfg.log.Warn("Could not write greylist file %s: %v", g.fileName, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// loadGreylist loads the greylist from the file; a file which does not exist is an empty greylist
+func loadGreylist(fileName string) (*greylist, error) {
+	g := &greylist{fileName: fileName, entries: make(map[string]*greylistEntry)}
+	if fileName == "" {
+		return g, nil
+	}
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &g.entries); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// check records the call of the caller and returns the greylist decision, with the time the caller was first seen; the greylist file is
+// written with the next write
+func (g *greylist) check(callerID string, spam *SpamFilterSpam, now time.Time) (decision string, firstSeen time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	entry, ok := g.entries[callerID]
+	switch {
+	case ok && now.Before(entry.Expires) && entry.Passed:
+		decision = greylistKnown
+		entry.Expires = now.Add(spam.GreylistExpiry.ToDuration())
+	case ok && now.Before(entry.Expires):
+		decision = greylistPassed
+		entry.Passed = true
+		entry.Expires = now.Add(spam.GreylistExpiry.ToDuration())
+	default:
+		decision = greylistBlocked
+		entry = &greylistEntry{FirstSeen: now, Expires: now.Add(spam.GreylistWindow.ToDuration())}
+		g.entries[callerID] = entry
+	}
+	g.dirty = true
+	return decision, entry.FirstSeen
+}
+
+// prune drops the entries which expired
+func (g *greylist) prune(now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for number, e := range g.entries {
+		if !now.Before(e.Expires) {
+			delete(g.entries, number)
+			g.dirty = true
+		}
+	}
+}
+
+// write writes the greylist file, if the greylist changed since it was last written; only the snapshot of the entries is taken under the lock,
+// so that calls are not held up by the file being written
+func (g *greylist) write() error {
+	g.writeLock.Lock()
+	defer g.writeLock.Unlock()
+	g.lock.Lock()
+	if !g.dirty || g.fileName == "" {
+		g.lock.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(g.entries, "", "  ")
+	if err == nil {
+		g.dirty = false
+	}
+	g.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(g.fileName, append(data, '\n')); err != nil {
+		g.lock.Lock()
+		g.dirty = true
+		g.lock.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package sipspamfilter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGreylist(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "greylist.json")
+	g, err := loadGreylist(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spam := &SpamFilterSpam{GreylistWindow: timeDuration(time.Hour), GreylistExpiry: timeDuration(24 * time.Hour)}
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	check := func(g *greylist, callerID string, at time.Duration, expected string) {
+		t.Helper()
+		if decision, _ := g.check(callerID, spam, start.Add(at)); decision != expected {
+			t.Errorf("%s after %s: expected %s, got %s", callerID, at, expected, decision)
+		}
+	}
+
+	check(g, "+447000000001", 0, greylistBlocked)
+	check(g, "+447000000001", 30*time.Minute, greylistPassed)
+	check(g, "+447000000001", 2*time.Hour, greylistKnown)
+	// a call back after the window is greylisted again
+	check(g, "+447000000002", 0, greylistBlocked)
+	check(g, "+447000000002", 2*time.Hour, greylistBlocked)
+
+	// the greylist is written in the background, not on every call
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Fatalf("expected the greylist file not to be written by the calls, got %v", err)
+	}
+	if err := g.write(); err != nil || g.dirty {
+		t.Fatalf("expected the greylist file to be written, got dirty=%t err=%v", g.dirty, err)
+	}
+
+	// the greylist is kept across restarts
+	g, err = loadGreylist(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.entries) != 2 {
+		t.Fatalf("expected 2 entries to be loaded, got %d", len(g.entries))
+	}
+	check(g, "+447000000002", 150*time.Minute, greylistPassed)
+	// entries are dropped once they expire
+	check(g, "+447000000003", 48*time.Hour, greylistBlocked)
+	g.prune(start.Add(48 * time.Hour))
+	if len(g.entries) != 1 {
+		t.Errorf("expected the expired entries to be dropped, got %d entries", len(g.entries))
+	}
+}
@@ -0,0 +1,306 @@
+package sipspamfilter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// listRecord is an entry of a structured (CSV, JSON or YAML) list file
+type listRecord struct {
+	Number     string `json:"number" yaml:"number"`
+	Category   string `json:"category,omitempty" yaml:"category,omitempty"`
+	Source     string `json:"source,omitempty" yaml:"source,omitempty"`
+	Added      string `json:"added,omitempty" yaml:"added,omitempty"`
+	Notes      string `json:"notes,omitempty" yaml:"notes,omitempty"`
+	Attributes string `json:"attributes,omitempty" yaml:"attributes,omitempty"` // key=value attributes, the same as in text list files
+}
+
+// listRecordColumns are the CSV columns, in the order they are written
+var listRecordColumns = []string{"number", "category", "source", "added", "notes", "attributes"}
+
+func (r *listRecord) column(name string) *string {
+	switch name {
+	case "number":
+		return &r.Number
+	case "category":
+		return &r.Category
+	case "source":
+		return &r.Source
+	case "added":
+		return &r.Added
+	case "notes":
+		return &r.Notes
+	case "attributes":
+		return &r.Attributes
+	}
+	return nil
+}
+
+// listLine converts the record to a list file line; the category, source and added date become attributes, and the notes the comment
+func (r *listRecord) listLine() listLine {
+	attributes := []string{}
+	for _, attr := range [][2]string{{"category", r.Category}, {"source", r.Source}, {"added", r.Added}} {
+		if attr[1] != "" {
+			attributes = append(attributes, formatAttribute(attr[0], attr[1]))
+		}
+	}
+	if r.Attributes != "" {
+		attributes = append(attributes, r.Attributes)
+	}
+	return listLine{
+		entry:      strings.TrimSpace(r.Number),
+		attributes: strings.Join(attributes, " "),
+		comment:    r.Notes,
+	}
+}
+
+// listFileFormat returns the structured format of the list file, by file extension, or an empty string for text list files
+func listFileFormat(filePath string) string {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".csv":
+		return "csv"
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return ""
+}
+
+// isHiddenFile returns true for hidden files and directories (starting with a .), such as the temporary files written next to list files
+// while they are replaced; they are not loaded from list directories
+func isHiddenFile(filePath string) bool {
+	return strings.HasPrefix(filepath.Base(filePath), ".")
+}
+
+// walkListFiles calls fn for the list file at path, or for each file in the directory at path and its subdirectories; hidden
+// files and subdirectories are skipped
+func walkListFiles(path string, fn func(filePath string, info os.FileInfo) error) error {
+	return filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == path {
+			if info.IsDir() {
+				return nil
+			}
+			return fn(filePath, info)
+		}
+		if info.IsDir() {
+			if isHiddenFile(filePath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isHiddenFile(filePath) {
+			return nil
+		}
+		return fn(filePath, info)
+	})
+}
+
+// readListFile calls fn for each entry and file defaults line of the list file, with the line number the entry starts on;
+// the content of the file is also written to hash
+func readListFile(filePath string, hash io.Writer, fn func(lineNo int, line listLine) error) error {
+	if listFileFormat(filePath) != "" {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		hash.Write(data)
+		records, lines, err := parseListRecords(filePath, data)
+		if err != nil {
+			return err
+		}
+		for i := range records {
+			if err := fn(lines[i], records[i].listLine()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(io.TeeReader(file, hash))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line, ok := parseListLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		if err := fn(lineNo, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// readListRecords reads a structured list file, returning the records and the line number each record starts on
+func readListRecords(filePath string) (records []listRecord, lines []int, err error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseListRecords(filePath, data)
+}
+
+func parseListRecords(filePath string, data []byte) (records []listRecord, lines []int, err error) {
+	switch listFileFormat(filePath) {
+	case "csv":
+		records, lines, err = readCSVRecords(data)
+	case "json":
+		records, lines, err = readJSONRecords(data)
+	case "yaml":
+		records, lines, err = readYAMLRecords(data)
+	default:
+		return nil, nil, fmt.Errorf("not a structured list file")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range records {
+		if strings.TrimSpace(records[i].Number) == "" {
+			return nil, nil, fmt.Errorf("record on line %d has no number", lines[i])
+		}
+	}
+	return records, lines, nil
+}
+
+// readCSVRecords reads CSV records; the first row is the header, naming the columns, and lines starting with # are comments
+func readCSVRecords(data []byte) (records []listRecord, lines []int, err error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	hasNumber := false
+	for _, name := range header {
+		name = strings.TrimSpace(name)
+		if (&listRecord{}).column(name) == nil {
+			return nil, nil, fmt.Errorf("unknown column %q, valid columns are %s", name, strings.Join(listRecordColumns, ", "))
+		}
+		hasNumber = hasNumber || name == "number"
+	}
+	if !hasNumber {
+		return nil, nil, fmt.Errorf("the header must contain a number column")
+	}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		record := listRecord{}
+		for i, value := range row {
+			*record.column(strings.TrimSpace(header[i])) = strings.TrimSpace(value)
+		}
+		line, _ := r.FieldPos(0)
+		records = append(records, record)
+		lines = append(lines, line)
+	}
+	return records, lines, nil
+}
+
+// readJSONRecords reads a JSON array of records
+func readJSONRecords(data []byte) (records []listRecord, lines []int, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil, nil, fmt.Errorf("the file must contain an array of records")
+	}
+	for decoder.More() {
+		// the offset is at the end of the previous token, skip to the start of the record
+		offset := int(decoder.InputOffset())
+		for offset < len(data) && strings.IndexByte(" \t\r\n,", data[offset]) >= 0 {
+			offset++
+		}
+		record := listRecord{}
+		if err := decoder.Decode(&record); err != nil {
+			return nil, nil, fmt.Errorf("record on line %d: %v", bytes.Count(data[:offset], []byte("\n"))+1, err)
+		}
+		records = append(records, record)
+		lines = append(lines, bytes.Count(data[:offset], []byte("\n"))+1)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, nil, err
+	}
+	return records, lines, nil
+}
+
+// readYAMLRecords reads a YAML sequence of records
+func readYAMLRecords(data []byte) (records []listRecord, lines []int, err error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&records); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	// decode again to find the line numbers of the records
+	document := yaml.Node{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, nil, err
+	}
+	if len(records) > 0 {
+		if len(document.Content) == 0 || len(document.Content[0].Content) != len(records) {
+			return nil, nil, fmt.Errorf("the file must contain a list of records")
+		}
+		for _, node := range document.Content[0].Content {
+			lines = append(lines, node.Line)
+		}
+	}
+	return records, lines, nil
+}
+
+// writeListRecords writes the records to a structured list file, in the format given by the file extension
+func writeListRecords(w io.Writer, filePath string, records []listRecord) error {
+	switch listFileFormat(filePath) {
+	case "csv":
+		writer := csv.NewWriter(w)
+		if err := writer.Write(listRecordColumns); err != nil {
+			return err
+		}
+		for _, record := range records {
+			row := []string{}
+			for _, name := range listRecordColumns {
+				row = append(row, *record.column(name))
+			}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(records); err != nil {
+			return err
+		}
+		return encoder.Close()
+	}
+	return fmt.Errorf("not a structured list file")
+}
@@ -0,0 +1,76 @@
+package sipspamfilter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rglonek/logger"
+)
+
+func TestStructuredListFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"list.csv":  "# comment\nnumber,category,source,added,notes,attributes\n+447000000001,robocall,customer report,2026-01-15,\"bank, \"\"fraud\"\"\",action=reject\n\n+44871*,premium,ofcom,,,\n",
+		"list.json": "[\n  {\"number\": \"+447000000002\", \"category\": \"robocall\", \"source\": \"customer report\", \"notes\": \"bank\"},\n\n  {\n    \"number\": \"+44872*\",\n    \"attributes\": \"action=reject\"\n  }\n]\n",
+		"list.yaml": "- number: \"+447000000003\"\n  category: robocall\n  source: customer report\n  added: 2026-01-15\n\n- number: \"+44873*\"\n  attributes: action=reject\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &spamFilter{config: &SpamFilterConfig{}, log: logger.NewLogger()}
+	cfg.log.SetLogLevel(logger.ERROR)
+	lists, _, err := cfg.parseNumberList("blacklist", []string{dir}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := newNumberIndex(lists)
+	tests := []struct {
+		callerID string
+		file     string
+		line     int
+		metadata entryMetadata
+		notes    string
+		action   string
+	}{
+		{"+447000000001", "list.csv", 3, entryMetadata{"robocall", "customer report", "2026-01-15"}, `bank, "fraud"`, "reject"},
+		{"+448710000000", "list.csv", 5, entryMetadata{"premium", "ofcom", ""}, "", "hangup"},
+		{"+447000000002", "list.json", 2, entryMetadata{"robocall", "customer report", ""}, "bank", "hangup"},
+		{"+448720000000", "list.json", 4, entryMetadata{}, "", "reject"},
+		{"+447000000003", "list.yaml", 1, entryMetadata{"robocall", "customer report", "2026-01-15"}, "", "hangup"},
+		{"+448730000000", "list.yaml", 6, entryMetadata{}, "", "reject"},
+	}
+	for _, test := range tests {
+		matches := idx.lookup(test.callerID)
+		if len(matches) != 1 {
+			t.Fatalf("%s: expected 1 match, got %d", test.callerID, len(matches))
+		}
+		match := matches[0]
+		if filepath.Base(match.list.fileName) != test.file || match.entry.lineNumber != test.line {
+			t.Errorf("%s: expected %s:%d, got %s:%d", test.callerID, test.file, test.line, match.list.fileName, match.entry.lineNumber)
+		}
+		if metadata := match.entry.attributes.entryMetadata(); metadata != test.metadata || match.entry.comment != test.notes {
+			t.Errorf("%s: expected %+v %q, got %+v %q", test.callerID, test.metadata, test.notes, metadata, match.entry.comment)
+		}
+		if action := match.entry.attributes.apply(blockAction{action: "hangup"}); action.action != test.action {
+			t.Errorf("%s: expected action %s, got %s", test.callerID, test.action, action.action)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"unknown.csv":  "number,reporter\n+447000000001,someone\n",
+		"unknown.json": "[{\"number\": \"+447000000001\", \"reporter\": \"someone\"}]",
+		"unknown.yaml": "- number: \"+447000000001\"\n  reporter: someone\n",
+		"missing.csv":  "number,category\n,robocall\n",
+	} {
+		file := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cfg.parseFile(file); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package sipspamfilter
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/emiago/sipgo/sip"
+	"gopkg.in/yaml.v3"
+)
+
+// listSet is a set of blacklists and whitelists with its spam settings: the global lists of the spam section, or the lists of a DID
+type listSet struct {
+	name             string          // the DID name, empty for the global lists
+	spam             *SpamFilterSpam // for DIDs, with the settings which are not set taken from the global spam section
+	blacklistNumbers *numberIndex    // protected by spamFilter.blacklistLock
+	whitelistNumbers *numberIndex    // protected by spamFilter.whitelistLock
+	callRate         *callRate       // calls of the callers which are not on any blacklist, nil if auto_blacklist is not enabled
+}
+
+// listName returns the name of the blacklist or whitelist of the set, as used in logs, the reload status and index file names
+func (s *listSet) listName(list string) string {
+	if s.name == "" {
+		return list
+	}
+	return s.name + "." + list
+}
+
+// didGlobalSettings apply to all lists, so they can only be set in the global spam section
+var didGlobalSettings = map[string]bool{
+	"compact_index":             true,
+	"index_dir":                 true,
+	"auto_reload":               true,
+	"auto_reload_delay":         true,
+	"auto_reload_poll":          true,
+	"auto_reload_poll_interval": true,
+	"reload_status_file":        true,
+	"strict_validation":         true,
+	"remote_list_cache_dir":     true,
+	"remote_list_interval":      true,
+	"remote_list_timeout":       true,
+	"remote_list_max_size_mb":   true,
+	"greylist_file":             true,
+}
+
+var didNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// didSpamSettings decodes the spam section of a DID over a copy of the global spam section, so that settings which are not set are taken from the global section
+func didSpamSettings(global SpamFilterSpam, node *yaml.Node) (SpamFilterSpam, error) {
+	spam := global
+	if node.Kind == 0 {
+		return spam, nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return spam, fmt.Errorf("spam must be a mapping of settings")
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		if didGlobalSettings[node.Content[i].Value] {
+			return spam, fmt.Errorf("%s can only be set in the global spam section", node.Content[i].Value)
+		}
+	}
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return spam, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&spam); err != nil {
+		return spam, err
+	}
+	return spam, nil
+}
+
+// validateSpamSettings validates the spam settings which are used while handling calls
+func validateSpamSettings(spam *SpamFilterSpam) error {
+	if err := validateCallerIDSources(spam.CallerIDSources); err != nil {
+		return err
+	}
+	switch spam.WithheldAction {
+	case "allow", "block", "reject":
+	default:
+		return fmt.Errorf("invalid withheld_action: %s, should be one of allow, block, reject", spam.WithheldAction)
+	}
+	switch spam.BlockAction {
+	case "hangup", "reject", "sit", "voicemail":
+	default:
+		return fmt.Errorf("invalid block_action: %s, should be one of hangup, reject, sit, voicemail", spam.BlockAction)
+	}
+	if spam.RejectCode < 400 || spam.RejectCode > 699 {
+		return fmt.Errorf("invalid reject_code: %d, should be a SIP status code between 400 and 699", spam.RejectCode)
+	}
+	if spam.Announcement != "" && spam.AnnouncementMaxDuration <= 0 {
+		return fmt.Errorf("announcement_max_duration must be greater than 0")
+	}
+	if spam.Greylist && (spam.GreylistWindow <= 0 || spam.GreylistExpiry <= 0) {
+		return fmt.Errorf("greylist_window and greylist_expiry must be greater than 0")
+	}
+	return nil
+}
+
+// configListSets returns the global list set, followed by the list sets of the DIDs, without the lists;
+// the auto blacklist file and the challenge whitelist file of a set are added to its blacklist and whitelist paths
+func configListSets(config *SpamFilterConfig) ([]*listSet, error) {
+	global := config.Spam
+	global.BlacklistPaths = autoBlacklistPaths(&global)
+	global.WhitelistPaths = challengeWhitelistPaths(&global)
+	sets := []*listSet{{spam: &global}}
+	names := make(map[string]bool)
+	for _, did := range config.DIDs {
+		if !didNamePattern.MatchString(did.Name) {
+			return nil, fmt.Errorf("invalid DID name %q, may only contain letters, digits, _ and -", did.Name)
+		}
+		if names[did.Name] {
+			return nil, fmt.Errorf("duplicate DID name %s", did.Name)
+		}
+		names[did.Name] = true
+		spam, err := didSpamSettings(config.Spam, &did.Spam)
+		if err != nil {
+			return nil, fmt.Errorf("DID %s: %v", did.Name, err)
+		}
+		if len(did.Numbers) == 0 {
+			return nil, fmt.Errorf("DID %s: numbers must contain at least one called number", did.Name)
+		}
+		spam.BlacklistPaths = autoBlacklistPaths(&spam)
+		spam.WhitelistPaths = challengeWhitelistPaths(&spam)
+		sets = append(sets, &listSet{name: did.Name, spam: &spam})
+	}
+	return sets, nil
+}
+
+// listPaths returns the paths of the blacklists and whitelists of the list sets, without duplicates
+func listPaths(sets []*listSet) []string {
+	paths := []string{}
+	seen := make(map[string]bool)
+	for _, set := range sets {
+		for _, p := range append(append([]string{}, set.spam.BlacklistPaths...), set.spam.WhitelistPaths...) {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
+// checkWrittenFiles rejects files the filter writes which are in a list path: they would be loaded as list files, and with auto_reload every
+// write would trigger another reload; a generated list file may only be in the paths of its own kind of list
+func checkWrittenFiles(config *SpamFilterConfig, sets []*listSet) error {
+	type writtenFile struct{ setting, fileName string }
+	paths := listPaths(sets)
+	written := []writtenFile{
+		{"reload_status_file", config.Spam.ReloadStatusFile},
+		{"greylist_file", config.Spam.GreylistFile},
+		{"remote_list_cache_dir", config.Spam.RemoteListCacheDir},
+	}
+	if config.Spam.CompactIndex {
+		written = append(written, writtenFile{"index_dir", config.Spam.IndexDir})
+	}
+	for _, w := range written {
+		if w.fileName == "" {
+			continue
+		}
+		if p := inListPath(w.fileName, paths); p != "" {
+			return fmt.Errorf("%s %s must not be in the list path %s", w.setting, w.fileName, p)
+		}
+	}
+	blacklistPaths, whitelistPaths := []string{}, []string{}
+	for _, set := range sets {
+		blacklistPaths = append(blacklistPaths, set.spam.BlacklistPaths...)
+		whitelistPaths = append(whitelistPaths, set.spam.WhitelistPaths...)
+	}
+	for _, set := range sets {
+		prefix := ""
+		if set.name != "" {
+			prefix = "DID " + set.name + ": "
+		}
+		if set.spam.AutoBlacklist {
+			if p := inListPath(set.spam.AutoBlacklistFile, whitelistPaths); p != "" {
+				return fmt.Errorf("%sauto_blacklist_file %s must not be in the whitelist path %s", prefix, set.spam.AutoBlacklistFile, p)
+			}
+		}
+		if set.spam.Challenge && set.spam.ChallengeWhitelistFile != "" {
+			if p := inListPath(set.spam.ChallengeWhitelistFile, blacklistPaths); p != "" {
+				return fmt.Errorf("%schallenge_whitelist_file %s must not be in the blacklist path %s", prefix, set.spam.ChallengeWhitelistFile, p)
+			}
+		}
+	}
+	return nil
+}
+
+// initListSets creates the global list set and the list sets of the DIDs
+func (cfg *spamFilter) initListSets() error {
+	sets, err := configListSets(cfg.config)
+	if err != nil {
+		return err
+	}
+	for _, set := range sets {
+		err := validateSpamSettings(set.spam)
+		if err == nil {
+			err = initAutoBlacklist(set.spam)
+		}
+		if err == nil {
+			err = initChallenge(set.spam)
+		}
+		if err == nil {
+			err = initVoicemail(set.spam)
+		}
+		if err != nil {
+			if set.name != "" {
+				return fmt.Errorf("DID %s: %v", set.name, err)
+			}
+			return err
+		}
+		if set.spam.AutoBlacklist {
+			set.callRate = newCallRate()
+		}
+	}
+	if err := checkWrittenFiles(cfg.config, sets); err != nil {
+		return err
+	}
+	cfg.lists = *sets[0]
+	cfg.dids = sets[1:]
+	cfg.didNumbers = make(map[string]*listSet)
+	for i, did := range cfg.config.DIDs {
+		set := cfg.dids[i]
+		for _, n := range did.Numbers {
+			number := cfg.numberingPlan.toInternational(n, "")
+			if other, ok := cfg.didNumbers[number]; ok {
+				return fmt.Errorf("DID %s: number %s is also a number of DID %s", did.Name, n, other.name)
+			}
+			cfg.didNumbers[number] = set
+		}
+	}
+	return nil
+}
+
+// listSets returns the global list set, followed by the list sets of the DIDs
+func (cfg *spamFilter) listSets() []*listSet {
+	return append([]*listSet{&cfg.lists}, cfg.dids...)
+}
+
+// calledListSet returns the list set of the DID called by the request, by the user of the To header or else of the Request-URI,
+// or the global list set; the called number is the number of the DID, or the number in the To header if no DID matched
+func (cfg *spamFilter) calledListSet(req *sip.Request) (lists *listSet, called string) {
+	uris := []sip.Uri{}
+	if to := req.To(); to != nil {
+		uris = append(uris, to.Address)
+	}
+	uris = append(uris, req.Recipient)
+	for _, uri := range uris {
+		original, number := cfg.numberingPlan.uriToInternational(uri)
+		if original == "" {
+			continue
+		}
+		if set, ok := cfg.didNumbers[number]; ok {
+			return set, number
+		}
+		if called == "" {
+			called = number
+		}
+	}
+	return &cfg.lists, called
+}
@@ -0,0 +1,139 @@
+package sipspamfilter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/creasty/defaults"
+	"github.com/emiago/sipgo/sip"
+	"github.com/rglonek/logger"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDIDListSets(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"global.txt":   "+447000000001\n",
+		"business.txt": "+447000000002 action=reject\n",
+		"white.txt":    "+447000000001\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	parse := func(text string) *SpamFilterConfig {
+		config := &SpamFilterConfig{}
+		if err := defaults.Set(config); err != nil {
+			t.Fatal(err)
+		}
+		decoder := yaml.NewDecoder(strings.NewReader(strings.ReplaceAll(text, "DIR", dir)))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+	config := parse(`
+spam:
+  blacklist_paths: [DIR/global.txt]
+  whitelist_paths: [DIR/white.txt]
+  hangup_delay: 5s
+dids:
+  - name: business
+    numbers: ["01632960001", "+441632960002"]
+    spam:
+      blacklist_paths: [DIR/business.txt]
+      withheld_action: reject
+  - name: family
+    numbers: ["+441632960003"]
+`)
+	plan, err := newNumberingPlan(config.CountryCode, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &spamFilter{config: config, log: logger.NewLogger(), numberingPlan: plan, stats: &stats{}}
+	cfg.log.SetLogLevel(logger.CRITICAL)
+	if err := cfg.initListSets(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.reload("startup"); err != nil {
+		t.Fatal(err)
+	}
+
+	called := func(to string, recipient string) (*listSet, string) {
+		req := sip.NewRequest(sip.INVITE, sip.Uri{User: recipient, Host: "example.com"})
+		req.AppendHeader(&sip.ToHeader{Address: sip.Uri{User: to, Host: "example.com"}})
+		return cfg.calledListSet(req)
+	}
+	business, number := called("01632960001", "user")
+	if business.name != "business" || number != "+441632960001" {
+		t.Fatalf("expected the business DID by the To header, got %q %s", business.name, number)
+	}
+	if set, _ := called("user", "+441632960002"); set != business {
+		t.Errorf("expected the business DID by the Request-URI, got %q", set.name)
+	}
+	if set, number := called("+441632960009", "user"); set != &cfg.lists || number != "+441632960009" {
+		t.Errorf("expected the global lists for other numbers, got %q %s", set.name, number)
+	}
+	family, _ := called("+441632960003", "user")
+
+	// settings which are not set are taken from the global spam section
+	if business.spam.WithheldAction != "reject" || cfg.lists.spam.WithheldAction != "allow" || business.spam.HangupDelay != cfg.lists.spam.HangupDelay {
+		t.Errorf("unexpected business DID settings: %+v", business.spam)
+	}
+	if matches, _ := cfg.isSpam(business, "+447000000002"); len(matches) != 1 {
+		t.Error("expected the business blacklist to be used")
+	}
+	if matches, _ := cfg.isSpam(business, "+447000000001"); matches != nil {
+		t.Error("expected the global blacklist not to be used for the business DID")
+	}
+	if matches, _ := cfg.isSpam(&cfg.lists, "+447000000002"); matches != nil {
+		t.Error("expected the business blacklist not to be used for the global lists")
+	}
+	// lists with the same paths share the index
+	if family.blacklistNumbers != cfg.lists.blacklistNumbers || business.whitelistNumbers != cfg.lists.whitelistNumbers {
+		t.Error("expected the family DID to share the global lists")
+	}
+
+	for _, text := range []string{
+		"dids:\n  - name: x\n    numbers: [\"+441632960001\"]\n    spam:\n      compact_index: true\n",
+		"dids:\n  - name: x\n    numbers: [\"+441632960001\"]\n    spam:\n      unknown: true\n",
+		"dids:\n  - name: x\n    numbers: [\"+441632960001\"]\n  - name: y\n    numbers: [\"01632960001\"]\n",
+		"dids:\n  - name: x y\n    numbers: [\"+441632960001\"]\n",
+	} {
+		cfg := &spamFilter{config: parse(text), numberingPlan: plan}
+		if err := cfg.initListSets(); err == nil {
+			t.Errorf("expected an error for:\n%s", text)
+		}
+	}
+}
+
+func TestWrittenFilesInListPaths(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]struct {
+		spam SpamFilterSpam
+		ok   bool
+	}{
+		"outside":               {SpamFilterSpam{BlacklistPaths: []string{dir + "/black"}, ReloadStatusFile: dir + "/status.json", GreylistFile: dir + "/greylist.json"}, true},
+		"reload status in dir":  {SpamFilterSpam{BlacklistPaths: []string{dir + "/black"}, ReloadStatusFile: dir + "/black/status.json"}, false},
+		"greylist is list file": {SpamFilterSpam{WhitelistPaths: []string{dir + "/white.txt"}, GreylistFile: dir + "/./white.txt"}, false},
+		"index dir in dir":      {SpamFilterSpam{BlacklistPaths: []string{dir}, CompactIndex: true, IndexDir: dir + "/index"}, false},
+		"index dir unused":      {SpamFilterSpam{BlacklistPaths: []string{dir}, IndexDir: dir + "/index"}, true},
+		"auto blacklist in own": {SpamFilterSpam{BlacklistPaths: []string{dir + "/black"}, AutoBlacklist: true, AutoBlacklistFile: dir + "/black/auto.txt"}, true},
+		"auto blacklist white":  {SpamFilterSpam{WhitelistPaths: []string{dir + "/white"}, AutoBlacklist: true, AutoBlacklistFile: dir + "/white/auto.txt"}, false},
+		"challenge in black":    {SpamFilterSpam{BlacklistPaths: []string{dir + "/black"}, Challenge: true, ChallengeWhitelistFile: dir + "/black/passed.txt"}, false},
+		"remote cache in dir":   {SpamFilterSpam{BlacklistPaths: []string{dir, "https://example.com/list.txt"}, RemoteListCacheDir: dir + "/cache"}, false},
+	}
+	for name, test := range tests {
+		config := &SpamFilterConfig{Spam: test.spam}
+		sets, err := configListSets(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkWrittenFiles(config, sets); (err == nil) != test.ok {
+			t.Errorf("%s: expected ok=%v, got %v", name, test.ok, err)
+		}
+	}
+}
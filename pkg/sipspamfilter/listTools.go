@@ -0,0 +1,371 @@
+package sipspamfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rglonek/logger"
+)
+
+// listFileLine is a line of a list file: an entry, a file defaults line, or a comment or empty line
+type listFileLine struct {
+	text   string // the line as written; for structured list files, the record in text list file format
+	lineNo int
+	line   listLine
+	ok     bool // false for comment and empty lines
+}
+
+// String returns the line in text list file format
+func (l listLine) String() string {
+	if l.defaults {
+		return strings.TrimSpace(fileDefaultsPrefix + " " + l.attributes)
+	}
+	text := l.entry
+	if l.attributes != "" {
+		text += " " + l.attributes
+	}
+	if l.comment != "" {
+		text += " # " + l.comment
+	}
+	return text
+}
+
+// readListFileLines reads all lines of a list file, including comments and empty lines for text list files
+func readListFileLines(filePath string) ([]listFileLine, error) {
+	if listFileFormat(filePath) != "" {
+		records, lines, err := readListRecords(filePath)
+		if err != nil {
+			return nil, err
+		}
+		fileLines := []listFileLine{}
+		for i := range records {
+			line := records[i].listLine()
+			fileLines = append(fileLines, listFileLine{text: line.String(), lineNo: lines[i], line: line, ok: true})
+		}
+		return fileLines, nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fileLines := []listFileLine{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, ok := parseListLine(scanner.Text())
+		fileLines = append(fileLines, listFileLine{text: scanner.Text(), lineNo: len(fileLines) + 1, line: line, ok: ok})
+	}
+	return fileLines, scanner.Err()
+}
+
+// writeListFiles writes the lines of the files to output, or to stdout if output is empty, in text list file format; fn is called for each entry,
+// and returns the entry to write, or an empty string to drop it. All files are read before output is written, so output may be one of the files.
+func writeListFiles(files []string, output string, fn func(file string, line listFileLine) string) error {
+	regexes := 0
+	for _, file := range files {
+		if strings.HasSuffix(file, ".regex") {
+			regexes++
+		}
+	}
+	if regexes != 0 && regexes != len(files) {
+		return fmt.Errorf("regex list files cannot be combined with other list files")
+	}
+	// numbers written to a regex list file would be read as regular expressions, and regular expressions written to another list file as numbers
+	if output != "" && strings.HasSuffix(output, ".regex") != (regexes != 0) {
+		if regexes != 0 {
+			return fmt.Errorf("the output of regex list files must be a .regex file")
+		}
+		return fmt.Errorf("the output of list files other than regex list files must not be a .regex file")
+	}
+	if listFileFormat(output) != "" {
+		return fmt.Errorf("the output must be a text list file")
+	}
+
+	out := []string{}
+	for _, file := range files {
+		lines, err := readListFileLines(file)
+		if err != nil {
+			return fmt.Errorf("error reading file %s: %v", file, err)
+		}
+		defaults := false
+		for _, l := range lines {
+			if !l.ok || l.line.defaults {
+				defaults = defaults || l.line.defaults
+				out = append(out, l.text)
+				continue
+			}
+			entry := fn(file, l)
+			if entry == "" {
+				continue
+			}
+			// the entry is the first word of the line, replace it to keep the rest of the line as written
+			out = append(out, strings.Replace(l.text, l.line.entry, entry, 1))
+		}
+		// the file defaults of a file must not apply to the entries of the next file
+		if defaults {
+			out = append(out, fileDefaultsPrefix)
+		}
+	}
+
+	data := []byte(strings.Join(out, "\n") + "\n")
+	if output == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(output, data, 0644)
+}
+
+// NormalizeLists writes the list files to output (stdout if empty) in text list file format, with the numbers, prefixes and ranges converted
+// to E.164 format using the numbering plan of the country code; entries which cannot be converted are written as they are, and logged
+func NormalizeLists(config *SpamFilterConfig, log *logger.Logger, files []string, output string) error {
+	plan, err := newNumberingPlan(config.CountryCode, config.NumberingPlan)
+	if err != nil {
+		return err
+	}
+	changed := 0
+	err = writeListFiles(files, output, func(file string, l listFileLine) string {
+		if strings.HasSuffix(file, ".regex") {
+			return l.line.entry
+		}
+		entry, err := plan.normalizeEntry(l.line.entry)
+		if err != nil {
+			log.Warn("%s:%d: not normalized: %s: %v", file, l.lineNo, l.line.entry, err)
+			return l.line.entry
+		}
+		if entry != l.line.entry {
+			changed++
+		}
+		return entry
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("Normalized %d entries", changed)
+	return nil
+}
+
+// normalizeEntry converts a list entry to E.164 format: numbers, the start and end of ranges, and prefixes
+func (p *numberingPlan) normalizeEntry(entry string) (string, error) {
+	if strings.HasSuffix(entry, "*") {
+		prefix := p.prefixToInternational(strings.TrimSuffix(entry, "*"))
+		if err := validateE164(prefix, true); err != nil {
+			return entry, err
+		}
+		return prefix + "*", nil
+	}
+	if isNumberRange(entry) {
+		start, end, err := parseNumberRange(entry)
+		if err != nil {
+			return entry, err
+		}
+		start, end = p.toInternational(start, ""), p.toInternational(end, "")
+		if len(start) != len(end) {
+			return entry, fmt.Errorf("range start and end do not convert to the same number of digits")
+		}
+		for _, n := range []string{start, end} {
+			if err := validateE164(n, false); err != nil {
+				return entry, err
+			}
+		}
+		return start + "-" + end, nil
+	}
+	number := p.toInternational(entry, "")
+	if err := validateE164(number, false); err != nil {
+		return entry, err
+	}
+	return number, nil
+}
+
+// MergeLists writes the list files to output (stdout if empty) as a single text list file, keeping comments and dropping duplicate entries
+func MergeLists(log *logger.Logger, files []string, output string) error {
+	seen := make(map[string]string)
+	duplicates := 0
+	err := writeListFiles(files, output, func(file string, l listFileLine) string {
+		if first, ok := seen[l.line.entry]; ok {
+			log.Info("%s:%d: dropping duplicate %s, first seen in %s", file, l.lineNo, l.line.entry, first)
+			duplicates++
+			return ""
+		}
+		seen[l.line.entry] = fmt.Sprintf("%s:%d", file, l.lineNo)
+		return l.line.entry
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("Merged %d files, %d duplicates dropped", len(files), duplicates)
+	return nil
+}
+
+// DedupeLists removes entries which are in more than one file of the blacklist or of the whitelist, keeping the first, and blacklist entries which are
+// already covered by the whitelist; the lists of the DID are used if did is set, otherwise the global lists. With dryRun, the entries are only logged.
+func DedupeLists(config *SpamFilterConfig, log *logger.Logger, did string, dryRun bool) error {
+	sets, err := configListSets(config)
+	if err != nil {
+		return err
+	}
+	var set *listSet
+	for _, s := range sets {
+		if s.name == did {
+			set = s
+		}
+	}
+	if set == nil {
+		return fmt.Errorf("unknown DID %s", did)
+	}
+	whitelistFiles, err := listFiles(localListPaths(config.Spam.RemoteListCacheDir, set.spam.WhitelistPaths))
+	if err != nil {
+		return err
+	}
+	problems := &listProblems{log: log}
+	whitelist := []*numberList{}
+	for _, file := range whitelistFiles {
+		list, err := parseListFile(file, problems)
+		if err != nil {
+			return fmt.Errorf("error parsing file %s: %v", file, err)
+		}
+		whitelist = append(whitelist, list)
+	}
+	whitelistIndex := newNumberIndex(whitelist)
+	whitelisted := make(map[string]string) // prefixes, ranges and regexes in the whitelist
+	for _, list := range whitelist {
+		for _, entries := range listEntries(list)[1:] {
+			for _, entry := range entries {
+				whitelisted[entry.number] = fmt.Sprintf("%s:%d", list.fileName, entry.lineNumber)
+			}
+		}
+	}
+
+	total := 0
+	for _, list := range []struct {
+		name  string
+		paths []string
+	}{{"blacklist", set.spam.BlacklistPaths}, {"whitelist", set.spam.WhitelistPaths}} {
+		files, err := listFiles(editableListPaths(list.paths, log))
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]string)
+		for _, file := range files {
+			regex := strings.HasSuffix(file, ".regex")
+			removed, err := removeEntries(file, dryRun, func(lineNo int, line listLine, fileDefaults string) bool {
+				key := line.entry
+				if regex {
+					key = "regex " + key
+				}
+				if first, ok := seen[key]; ok {
+					log.Info("%s:%d: duplicate %s, first seen in %s", file, lineNo, line.entry, first)
+					return true
+				}
+				seen[key] = fmt.Sprintf("%s:%d", file, lineNo)
+				if list.name != "blacklist" {
+					return false
+				}
+				if first, ok := whitelisted[line.entry]; ok {
+					log.Info("%s:%d: %s is also in the whitelist, in %s", file, lineNo, line.entry, first)
+					return true
+				}
+				if regex || strings.HasSuffix(line.entry, "*") || isNumberRange(line.entry) {
+					return false
+				}
+				if matches := whitelistIndex.lookup(line.entry); len(matches) > 0 {
+					log.Info("%s:%d: %s is whitelisted by %s in %s:%d", file, lineNo, line.entry, matches[0].entry.number, matches[0].list.fileName, matches[0].entry.lineNumber)
+					return true
+				}
+				return false
+			})
+			if err != nil {
+				return fmt.Errorf("error deduplicating file %s: %v", file, err)
+			}
+			total += removed
+		}
+	}
+	if dryRun {
+		log.Info("Found %d duplicate entries, no files were changed", total)
+	} else {
+		log.Info("Removed %d duplicate entries, send SIGUSR1 to reload the lists", total)
+	}
+	return nil
+}
+
+// DiffLists compares two list sets, each a list of files and directories, and writes the entries only in a, the entries only in b, and the entries
+// of b which have different attributes or comments in a to w, in text list file format, with a comment line before each section; returns the number of differences
+func DiffLists(a []string, b []string, w io.Writer) (differences int, err error) {
+	aEntries, aOrder, err := readListSet(a)
+	if err != nil {
+		return 0, err
+	}
+	bEntries, bOrder, err := readListSet(b)
+	if err != nil {
+		return 0, err
+	}
+
+	onlyA, onlyB, changed := []string{}, []string{}, []string{}
+	for _, key := range aOrder {
+		if _, ok := bEntries[key]; !ok {
+			onlyA = append(onlyA, aEntries[key].String())
+		}
+	}
+	for _, key := range bOrder {
+		old, ok := aEntries[key]
+		if !ok {
+			onlyB = append(onlyB, bEntries[key].String())
+		} else if old.attributes != bEntries[key].attributes || old.comment != bEntries[key].comment {
+			changed = append(changed, bEntries[key].String())
+		}
+	}
+	for _, section := range []struct {
+		title   string
+		entries []string
+	}{
+		{"Only in " + strings.Join(a, ", "), onlyA},
+		{"Only in " + strings.Join(b, ", "), onlyB},
+		{"Changed in " + strings.Join(b, ", "), changed},
+	} {
+		if len(section.entries) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "# %s\n%s\n", section.title, strings.Join(section.entries, "\n")); err != nil {
+			return 0, err
+		}
+	}
+	return len(onlyA) + len(onlyB) + len(changed), nil
+}
+
+// readListSet reads the entries of the list files in the paths, with the file defaults applied to the attributes, by entry; the order is the order of the entries in the files
+func readListSet(paths []string) (entries map[string]listLine, order []string, err error) {
+	files, err := listFiles(paths)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries = make(map[string]listLine)
+	for _, file := range files {
+		lines, err := readListFileLines(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading file %s: %v", file, err)
+		}
+		fileDefaults := ""
+		for _, l := range lines {
+			if l.ok && l.line.defaults {
+				fileDefaults = l.line.attributes
+			}
+			if !l.ok || l.line.defaults {
+				continue
+			}
+			key := l.line.entry
+			if strings.HasSuffix(file, ".regex") {
+				key = "regex " + key
+			}
+			if _, ok := entries[key]; ok {
+				continue
+			}
+			line := l.line
+			line.attributes = strings.TrimSpace(fileDefaults + " " + line.attributes)
+			entries[key] = line
+			order = append(order, key)
+		}
+	}
+	return entries, order, nil
+}
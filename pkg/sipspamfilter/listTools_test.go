@@ -0,0 +1,95 @@
+package sipspamfilter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rglonek/logger"
+)
+
+func TestListTools(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	read := func(path string) string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	log := logger.NewLogger()
+	log.SetLogLevel(logger.CRITICAL)
+	config := &SpamFilterConfig{CountryCode: "44"}
+
+	a := write("a.txt", "#! category=spam\n# header\n07000000001 action=reject # first\n00447000000002\n07000000001-07000000009\n0871*\nanonymous\n")
+	b := write("b.csv", "number,notes\n+447000000003,csv\n")
+	if err := NormalizeLists(config, log, []string{a, b}, a); err != nil {
+		t.Fatal(err)
+	}
+	expected := "#! category=spam\n# header\n+447000000001 action=reject # first\n+447000000002\n+447000000001-+447000000009\n+44871*\nanonymous\n#!\n+447000000003 # csv\n"
+	if got := read(a); got != expected {
+		t.Errorf("unexpected normalized file:\n%s", got)
+	}
+
+	merged := filepath.Join(dir, "merged.txt")
+	c := write("c.txt", "# other\n+447000000002 # duplicate\n+447000000004\n")
+	if err := MergeLists(log, []string{c, b}, merged); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(merged); got != "# other\n+447000000002 # duplicate\n+447000000004\n+447000000003 # csv\n" {
+		t.Errorf("unexpected merged file:\n%s", got)
+	}
+	d := write("d.regex", `\+44.*`)
+	if err := MergeLists(log, []string{c, d}, merged); err == nil {
+		t.Error("expected regex list files not to be merged with other list files")
+	}
+	if err := MergeLists(log, []string{d}, merged); err == nil {
+		t.Error("expected regex list files not to be merged into a list file which is not a regex list file")
+	}
+	if err := MergeLists(log, []string{c}, filepath.Join(dir, "merged.regex")); err == nil {
+		t.Error("expected list files not to be merged into a regex list file")
+	}
+
+	// the second file of the blacklist repeats entries of the first, and the whitelist covers an entry
+	black := write("black/1.txt", "+447000000001\n+447000000002\n+44871*\n")
+	black2 := write("black/2.txt", "# comment\n+447000000001\n+447000000005\n+441632960001\n+44872*\n")
+	write("white/white.txt", "+441632960000-+441632960999\n+44872*\n")
+	config.Spam.BlacklistPaths = []string{filepath.Join(dir, "black")}
+	config.Spam.WhitelistPaths = []string{filepath.Join(dir, "white")}
+	if err := DedupeLists(config, log, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(black2); got != "# comment\n+447000000001\n+447000000005\n+441632960001\n+44872*\n" {
+		t.Errorf("expected the dry run not to change the file, got:\n%s", got)
+	}
+	if err := DedupeLists(config, log, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(black2); got != "# comment\n+447000000005\n" {
+		t.Errorf("unexpected deduplicated file:\n%s", got)
+	}
+	if got := read(black); got != "+447000000001\n+447000000002\n+44871*\n" {
+		t.Errorf("expected the first file to be unchanged, got:\n%s", got)
+	}
+
+	out := &bytes.Buffer{}
+	differences, err := DiffLists([]string{black}, []string{c}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "# Only in " + black + "\n+447000000001\n+44871*\n# Only in " + c + "\n+447000000004\n# Changed in " + c + "\n+447000000002 # duplicate\n"
+	if differences != 4 || out.String() != expected {
+		t.Errorf("unexpected diff with %d differences:\n%s", differences, out.String())
+	}
+}
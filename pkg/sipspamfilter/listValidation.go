@@ -0,0 +1,228 @@
+package sipspamfilter
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/rglonek/logger"
+)
+
+const (
+	e164MaxDigits = 15 // including the country code
+	e164MinDigits = 7  // the shortest numbers in use have a 3 digit country code and a 4 digit subscriber number
+)
+
+// listProblem is a problem found in a list file; line is 0 if the problem is not on a specific line
+type listProblem struct {
+	file    string
+	line    int
+	message string
+	invalid bool // the entry is not a valid E.164 number, prefix or range; fails the parsing of the file with strict validation
+}
+
+func (p listProblem) String() string {
+	if p.line == 0 {
+		return fmt.Sprintf("%s: %s", p.file, p.message)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.file, p.line, p.message)
+}
+
+// listProblems collects the problems found while parsing list files; with a logger, each problem is also logged as it is found
+type listProblems struct {
+	log      *logger.Logger // nil to only collect the problems
+	strict   bool           // invalid entries are logged as errors, and fail the parsing of the file
+	problems []listProblem
+}
+
+// add adds a problem which is a warning, such as a duplicate entry or an invalid attribute
+func (p *listProblems) add(file string, line int, format string, args ...interface{}) {
+	p.addProblem(listProblem{file: file, line: line, message: fmt.Sprintf(format, args...)})
+}
+
+// addInvalid adds an entry which is not a valid E.164 number, prefix or range
+func (p *listProblems) addInvalid(file string, line int, format string, args ...interface{}) {
+	p.addProblem(listProblem{file: file, line: line, message: fmt.Sprintf(format, args...), invalid: true})
+}
+
+func (p *listProblems) addProblem(problem listProblem) {
+	p.problems = append(p.problems, problem)
+	if p.log == nil {
+		return
+	}
+	if p.strict && problem.invalid {
+		p.log.Error("%s", problem)
+	} else {
+		p.log.Warn("%s", problem)
+	}
+}
+
+// invalidEntries returns the problems which are invalid entries, which fail the parsing of the file with strict validation
+func (p *listProblems) invalidEntries() (invalid []listProblem) {
+	for _, problem := range p.problems {
+		if problem.invalid {
+			invalid = append(invalid, problem)
+		}
+	}
+	return invalid
+}
+
+// validateE164 checks that the number or prefix is in E.164 format: a + followed by the country code, which does not start with 0, and at most 15 digits in total
+func validateE164(entry string, prefix bool) error {
+	if !strings.HasPrefix(entry, "+") {
+		return fmt.Errorf("not in E.164 format, must start with +")
+	}
+	digits := strings.TrimPrefix(entry, "+")
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("not in E.164 format, may only contain digits after the +")
+		}
+	}
+	if strings.HasPrefix(digits, "0") {
+		return fmt.Errorf("not in E.164 format, country codes do not start with 0")
+	}
+	if len(digits) > e164MaxDigits {
+		return fmt.Errorf("too long, E.164 numbers have at most %d digits", e164MaxDigits)
+	}
+	if !prefix && len(digits) < e164MinDigits {
+		return fmt.Errorf("too short, E.164 numbers have at least %d digits", e164MinDigits)
+	}
+	return nil
+}
+
+// CheckLists parses all blacklist and whitelist files without starting the spam filter, and writes every problem to w: problems in the list files,
+// entries which are in more than one file of a list, and numbers which are both blacklisted and whitelisted; returns the number of problems.
+// The lists of each DID are checked as well.
+func CheckLists(config *SpamFilterConfig, w io.Writer) (problems int, err error) {
+	sets, err := configListSets(config)
+	if err != nil {
+		return 0, err
+	}
+	p := &listProblems{}
+	parsed := make(map[string]*numberList) // files may be in the lists of more than one list set, only parse them once
+	for _, set := range sets {
+		indexes := make(map[string]*numberIndex)
+		for _, list := range []struct {
+			name  string
+			paths []string
+		}{{"blacklist", set.spam.BlacklistPaths}, {"whitelist", set.spam.WhitelistPaths}} {
+			// remote lists are checked offline, using the cached copies
+			files, err := listFiles(localListPaths(config.Spam.RemoteListCacheDir, list.paths))
+			if err != nil {
+				return 0, fmt.Errorf("could not access %s paths: %v", set.listName(list.name), err)
+			}
+			lists := []*numberList{}
+			for _, file := range files {
+				l, ok := parsed[file]
+				if !ok {
+					l, err = parseListFile(file, p)
+					if err != nil {
+						p.add(file, 0, "%v", err)
+					}
+					parsed[file] = l
+				}
+				if l != nil {
+					lists = append(lists, l)
+				}
+			}
+			checkDuplicates(set.listName(list.name), lists, p)
+			indexes[list.name] = newNumberIndex(lists)
+		}
+		checkConflicts(set, indexes["blacklist"], indexes["whitelist"], p)
+	}
+
+	// list sets with the same files have the same problems
+	seen := make(map[listProblem]bool)
+	unique := p.problems[:0]
+	for _, problem := range p.problems {
+		if !seen[problem] {
+			seen[problem] = true
+			unique = append(unique, problem)
+		}
+	}
+	p.problems = unique
+	sort.SliceStable(p.problems, func(i, j int) bool {
+		if p.problems[i].file != p.problems[j].file {
+			return p.problems[i].file < p.problems[j].file
+		}
+		return p.problems[i].line < p.problems[j].line
+	})
+	for _, problem := range p.problems {
+		if _, err := fmt.Fprintln(w, problem); err != nil {
+			return 0, err
+		}
+	}
+	return len(p.problems), nil
+}
+
+// checkDuplicates reports entries which are in more than one file of the list; duplicates within a file are reported while parsing it
+func checkDuplicates(name string, lists []*numberList, p *listProblems) {
+	seen := make(map[string]listMatch)
+	for _, list := range lists {
+		for _, entries := range listEntries(list) {
+			for _, entry := range entries {
+				if first, ok := seen[entry.number]; ok && first.list != list {
+					p.add(list.fileName, entry.lineNumber, "%s is also in %s file %s:%d", entry.number, name, first.list.fileName, first.entry.lineNumber)
+					continue
+				}
+				seen[entry.number] = listMatch{list, entry}
+			}
+		}
+	}
+}
+
+// checkConflicts reports numbers which are both blacklisted and whitelisted, and prefixes, ranges and regexes which are in both lists;
+// whitelisted numbers are allowed, so the conflict is reported on the blacklist entry
+func checkConflicts(set *listSet, blacklist *numberIndex, whitelist *numberIndex, p *listProblems) {
+	whitelisted := make(map[string]listMatch)
+	for _, list := range whitelist.lists {
+		for _, entries := range listEntries(list)[1:] {
+			for _, entry := range entries {
+				whitelisted[entry.number] = listMatch{list, entry}
+			}
+		}
+	}
+	for _, list := range blacklist.lists {
+		for i, entries := range listEntries(list) {
+			for _, entry := range entries {
+				if i == 0 {
+					for _, match := range whitelist.lookup(entry.number) {
+						p.add(list.fileName, entry.lineNumber, "blacklisted number %s is whitelisted by %s in %s file %s:%d", entry.number, match.entry.number, set.listName("whitelist"), match.list.fileName, match.entry.lineNumber)
+					}
+				} else if match, ok := whitelisted[entry.number]; ok {
+					p.add(list.fileName, entry.lineNumber, "%s entry %s is also in %s file %s:%d", set.listName("blacklist"), entry.number, set.listName("whitelist"), match.list.fileName, match.entry.lineNumber)
+				}
+			}
+		}
+	}
+	// numbers only whitelisted by exact entries have been found above; also find whitelisted numbers covered by blacklist prefixes, ranges and regexes
+	for _, list := range whitelist.lists {
+		for i := range list.numbers {
+			entry := &list.numbers[i]
+			for _, match := range blacklist.lookup(entry.number) {
+				if match.entry.number != entry.number {
+					p.add(match.list.fileName, match.entry.lineNumber, "%s entry %s matches number %s, which is in %s file %s:%d", set.listName("blacklist"), match.entry.number, entry.number, set.listName("whitelist"), list.fileName, entry.lineNumber)
+				}
+			}
+		}
+	}
+}
+
+// listEntries returns the entries of the list: the numbers first, followed by the prefixes, ranges and regexes
+func listEntries(list *numberList) [][]*number {
+	entries := make([][]*number, 4)
+	for i := range list.numbers {
+		entries[0] = append(entries[0], &list.numbers[i])
+	}
+	for i := range list.prefixes {
+		entries[1] = append(entries[1], &list.prefixes[i])
+	}
+	for i := range list.ranges {
+		entries[2] = append(entries[2], &list.ranges[i].entry)
+	}
+	for i := range list.regexes {
+		entries[3] = append(entries[3], &list.regexes[i].entry)
+	}
+	return entries
+}
@@ -0,0 +1,107 @@
+package sipspamfilter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rglonek/logger"
+)
+
+func TestStrictValidation(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "blacklist.txt")
+	if err := os.WriteFile(file, []byte("+447000000001\n+441632960000-+441632960999\n+44871*\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &spamFilter{
+		config: &SpamFilterConfig{Spam: SpamFilterSpam{BlacklistPaths: []string{dir}, StrictValidation: true}},
+		log:    logger.NewLogger(),
+	}
+	cfg.log.SetLogLevel(logger.CRITICAL)
+	cfg.lists.spam = &cfg.config.Spam
+	if err := cfg.reload("startup"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"+44 abc", "+44700000000a", "447000000002", "+0447000000002", "+4470000000000000", "+441632-+441633", "+44871*5"} {
+		if err := os.WriteFile(file, []byte("+447000000001\n"+line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.reload("test"); err == nil {
+			t.Errorf("expected %q to fail the reload", line)
+		}
+		if matches := cfg.lists.blacklistNumbers.lookup("+441632960001"); len(matches) != 1 {
+			t.Errorf("expected the previous lists to remain in use after %q", line)
+		}
+	}
+
+	// duplicates, overlapping ranges and invalid attributes are only warnings, also with strict validation
+	for _, line := range []string{"+447000000001", "+441632960100-+441632960199", "+44871* action=drop"} {
+		if err := os.WriteFile(file, []byte("+447000000001\n+441632960000-+441632960999\n"+line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.reload("test"); err != nil {
+			t.Errorf("expected %q not to fail the reload: %v", line, err)
+		}
+	}
+
+	// without strict validation, entries which are not in E.164 format are loaded as written
+	cfg.config.Spam.StrictValidation = false
+	if err := cfg.reload("test"); err != nil {
+		t.Fatal(err)
+	}
+	if matches := cfg.lists.blacklistNumbers.lookup("+44871123456"); len(matches) != 1 {
+		t.Errorf("expected the prefix to be loaded, got %d matches", len(matches))
+	}
+}
+
+func TestCheckLists(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"black/a.txt":     "+447000000001\n+44 abc\n+447000000002\n+447000000002\n+44871*\n",
+		"black/b.txt":     "+447000000001\n+441632960000-+441632960999\n",
+		"white/white.txt": "+447000000002\n+441632960001\n+44871*\n",
+		"white/bad.regex": "(\n",
+		"white/other.txt": "+447000000003 # not blacklisted\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := &SpamFilterConfig{Spam: SpamFilterSpam{
+		BlacklistPaths: []string{filepath.Join(dir, "black")},
+		WhitelistPaths: []string{filepath.Join(dir, "white")},
+	}}
+	out := &bytes.Buffer{}
+	problems, err := CheckLists(config, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := filepath.Join(dir, "black/a.txt"), filepath.Join(dir, "black/b.txt")
+	expected := []string{
+		a + ":2: +44 abc: not in E.164 format",
+		a + ":3: blacklisted number +447000000002 is whitelisted by +447000000002",
+		a + ":4: ignoring duplicate +447000000002, first seen on line 3",
+		a + ":5: blacklist entry +44871* is also in whitelist file",
+		b + ":1: +447000000001 is also in blacklist file " + a + ":1",
+		b + ":2: blacklist entry +441632960000-+441632960999 matches number +441632960001",
+		filepath.Join(dir, "white/bad.regex") + ": invalid regex on line 1",
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if problems != len(lines) || problems != len(expected) {
+		t.Fatalf("expected %d problems, got %d:\n%s", len(expected), problems, out.String())
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("expected problem %d to start with %q, got %q", i, prefix, lines[i])
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package sipspamfilter
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// initListWatcher reloads the lists when a list file changes, using inotify where supported and polling otherwise;
+// changes are debounced, so that a burst of edits results in a single reload; remote lists are reloaded when they are refreshed instead
+func (cfg *spamFilter) initListWatcher() {
+	paths := []string{}
+	for _, p := range listPaths(cfg.listSets()) {
+		if !isRemoteList(p) {
+			paths = append(paths, p)
+		}
+	}
+	changes := make(chan struct{}, 1)
+	changed := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+
+	if cfg.config.Spam.AutoReloadPoll {
+		cfg.log.Info("Watching list files for changes, polling every %s", cfg.config.Spam.AutoReloadPollInterval.ToDuration())
+		go pollListFiles(paths, cfg.config.Spam.AutoReloadPollInterval.ToDuration(), changed)
+	} else if err := watchListFiles(paths, changed, cfg.log); err != nil {
+		cfg.log.Warn("Could not watch list files with inotify, polling every %s instead: %v", cfg.config.Spam.AutoReloadPollInterval.ToDuration(), err)
+		go pollListFiles(paths, cfg.config.Spam.AutoReloadPollInterval.ToDuration(), changed)
+	} else {
+		cfg.log.Info("Watching list files for changes with inotify")
+	}
+
+	go func() {
+		delay := cfg.config.Spam.AutoReloadDelay.ToDuration()
+		for range changes {
+			// wait until the files have not changed for the delay
+			timer := time.NewTimer(delay)
+		debounce:
+			for {
+				select {
+				case <-changes:
+					timer.Reset(delay)
+				case <-timer.C:
+					break debounce
+				}
+			}
+			cfg.requestReload("List files changed")
+		}
+	}()
+}
+
+// pollListFiles calls changed whenever a list file is added, removed or modified (by size and modification time); editor swap and
+// backup files are ignored
+func pollListFiles(paths []string, interval time.Duration, changed func()) {
+	fingerprint := func() string {
+		fingerprint := []string{}
+		for _, path := range paths {
+			err := walkListFiles(path, func(filePath string, info os.FileInfo) error {
+				if !isEditorTempFile(filePath) {
+					fingerprint = append(fingerprint, filePath+"\t"+strconv.FormatInt(info.Size(), 10)+"\t"+strconv.FormatInt(info.ModTime().UnixNano(), 10))
+				}
+				return nil
+			})
+			if err != nil {
+				return "error: " + err.Error()
+			}
+		}
+		return strings.Join(fingerprint, "\n")
+	}
+	last := fingerprint()
+	for {
+		time.Sleep(interval)
+		if current := fingerprint(); current != last {
+			last = current
+			changed()
+		}
+	}
+}
+
+// isEditorTempFile returns true for the swap and backup files editors write next to a list file while it is edited; the watcher
+// ignores them, as the list file itself changes as well when it is saved
+func isEditorTempFile(name string) bool {
+	if strings.HasSuffix(name, "~") {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".swp", ".swo", ".swx":
+		return true
+	}
+	return false
+}
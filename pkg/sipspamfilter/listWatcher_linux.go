@@ -0,0 +1,148 @@
+//go:build linux
+
+package sipspamfilter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/rglonek/logger"
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_ATTRIB | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// inotifyWatcher watches list directories recursively, and the parent directories of list files, as editors often replace files instead of writing to them
+type inotifyWatcher struct {
+	fd        int
+	lock      sync.Mutex
+	dirs      map[int]string  // watch descriptor -> directory
+	recursive map[string]bool // directories which are list paths, or below one
+	files     map[string]bool // list files, which are watched through their parent directory
+}
+
+// watchListFiles calls changed whenever a list file in the paths changes
+func watchListFiles(paths []string, changed func(), log *logger.Logger) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	w := &inotifyWatcher{
+		fd:        fd,
+		dirs:      make(map[int]string),
+		recursive: make(map[string]bool),
+		files:     make(map[string]bool),
+	}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			unix.Close(fd)
+			return err
+		}
+		if fileInfo.IsDir() {
+			err = w.addRecursive(path)
+		} else {
+			w.files[path] = true
+			err = w.add(filepath.Dir(path))
+		}
+		if err != nil {
+			unix.Close(fd)
+			return err
+		}
+	}
+	go w.read(changed, log)
+	return nil
+}
+
+func (w *inotifyWatcher) add(dir string) error {
+	wd, err := unix.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return err
+	}
+	w.lock.Lock()
+	w.dirs[wd] = dir
+	w.lock.Unlock()
+	return nil
+}
+
+func (w *inotifyWatcher) addRecursive(path string) error {
+	return filepath.Walk(path, func(dir string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		// hidden directories are skipped, like when the lists are loaded
+		if dir != path && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		w.lock.Lock()
+		w.recursive[dir] = true
+		w.lock.Unlock()
+		return w.add(dir)
+	})
+}
+
+func (w *inotifyWatcher) read(changed func(), log *logger.Logger) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Error("Error reading inotify events, list files are no longer watched: %v", err)
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				changed()
+				continue
+			}
+			name := string(nameBytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			w.lock.Lock()
+			dir, ok := w.dirs[int(event.Wd)]
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(w.dirs, int(event.Wd))
+			}
+			recursive := w.recursive[dir]
+			w.lock.Unlock()
+			if !ok {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			switch {
+			case recursive && event.Mask&unix.IN_ISDIR != 0:
+				if strings.HasPrefix(name, ".") {
+					break
+				}
+				// new directories below a list path must be watched too
+				if event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+					if err := w.addRecursive(path); err != nil {
+						log.Warn("Could not watch new directory %s: %v", path, err)
+					}
+				}
+				changed()
+			case recursive:
+				// hidden temporary files and editor swap and backup files written next to list files do not change the lists
+				if name == "" || !isHiddenFile(name) && !isEditorTempFile(name) {
+					changed()
+				}
+			case name == "" || w.files[path]:
+				changed()
+			}
+		}
+	}
+}
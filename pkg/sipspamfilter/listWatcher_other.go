@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sipspamfilter
+
+import (
+	"errors"
+
+	"github.com/rglonek/logger"
+)
+
+// watchListFiles is only supported on linux, list files are polled for changes on other platforms
+func watchListFiles(paths []string, changed func(), log *logger.Logger) error {
+	return errors.New("inotify is only supported on linux")
+}
@@ -0,0 +1,114 @@
+package sipspamfilter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rglonek/logger"
+)
+
+func TestListWatcher(t *testing.T) {
+	dir := t.TempDir()
+	listDir := filepath.Join(dir, "lists")
+	listFile := filepath.Join(dir, "blacklist.txt")
+	if err := os.Mkdir(listDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{listFile, filepath.Join(dir, "other.txt")} {
+		if err := os.WriteFile(file, []byte("+447000000001\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log := logger.NewLogger()
+	log.SetLogLevel(logger.ERROR)
+	paths := []string{listDir, listFile}
+
+	watchers := map[string]func(changed func()) error{
+		"inotify": func(changed func()) error {
+			return watchListFiles(paths, changed, log)
+		},
+		"poll": func(changed func()) error {
+			go pollListFiles(paths, 10*time.Millisecond, changed)
+			return nil
+		},
+	}
+	// like the reload debounce, events which follow each other within this interval belong to the same change
+	const quiet = 100 * time.Millisecond
+	for name, watch := range watchers {
+		changes := make(chan struct{}, 100)
+		if err := watch(func() { changes <- struct{}{} }); err != nil {
+			t.Logf("%s: not supported: %v", name, err)
+			continue
+		}
+		expect := func(what string, changed bool) {
+			t.Helper()
+			select {
+			case <-changes:
+				if !changed {
+					t.Errorf("%s: %s: unexpected change", name, what)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if changed {
+					t.Errorf("%s: %s: change not detected", name, what)
+				}
+			}
+			// drain the events of the same change, until none arrives within the quiet interval; polling may see a file while it is
+			// written, and again once written
+			for drained := false; !drained; {
+				select {
+				case <-changes:
+				case <-time.After(quiet):
+					drained = true
+				}
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		if err := os.WriteFile(listFile, []byte("+447000000002\n+447000000003\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		expect("list file modified", true)
+		if err := os.WriteFile(filepath.Join(dir, "other.txt"), []byte("+447000000002\n+447000000003\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		expect("other file modified", false)
+		subDir := filepath.Join(listDir, name)
+		if err := os.Mkdir(subDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		expect("directory created", name == "inotify")
+		if err := os.WriteFile(filepath.Join(subDir, "new.txt"), []byte("+447000000004\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		expect("file created in new directory", true)
+		for _, file := range []string{"." + name + ".txt.123456", name + ".txt~"} {
+			if err := os.WriteFile(filepath.Join(listDir, file), []byte("+447000000005\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			expect(file+" created", false)
+		}
+	}
+
+	// hidden files are not loaded either, while files with any other name are
+	if err := os.WriteFile(filepath.Join(listDir, "spam.numbers"), []byte("+447000000006\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := listFiles([]string{listDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := false
+	for _, file := range files {
+		if strings.HasPrefix(filepath.Base(file), ".") {
+			t.Errorf("expected hidden files not to be loaded, got %s", file)
+		}
+		if filepath.Base(file) == "spam.numbers" {
+			loaded = true
+		}
+	}
+	if !loaded {
+		t.Errorf("expected spam.numbers to be loaded, got %v", files)
+	}
+}
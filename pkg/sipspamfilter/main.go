@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,11 +26,20 @@ import (
 
 type spamFilter struct {
 	config                     *SpamFilterConfig
-	blacklistNumbers           []*numberList
-	blacklistLock              sync.RWMutex // if we are reloading, we lock, if we are reading, we rlock
-	whitelistNumbers           []*numberList
-	whitelistLock              sync.RWMutex // if we are reloading, we lock, if we are reading, we rlock
-	parserLock                 sync.Mutex   // only one parser at a time, all others will be blocked and queued
+	lists                      listSet             // the global lists and spam settings
+	dids                       []*listSet          // the lists and spam settings of the DIDs
+	didNumbers                 map[string]*listSet // the DID list sets, by called number in E.164 format
+	blacklistLock              sync.RWMutex        // protects the blacklists of all list sets; if we are reloading, we lock, if we are reading, we rlock
+	whitelistLock              sync.RWMutex        // protects the whitelists of all list sets; if we are reloading, we lock, if we are reading, we rlock
+	parserLock                 sync.Mutex          // only one parser at a time, all others will be blocked and queued
+	reloadRequests             chan string         // queued reload, with the reason; holds at most one reload
+	reloadStatus               reloadStatus        // status of the last reload
+	reloadCoalesced            int                 // reload requests merged into the queued reload
+	reloadStatusLock           sync.Mutex
+	remoteLists                []*remoteList
+	greylist                   *greylist      // nil if no list set uses greylisting
+	generatedListLock          sync.Mutex     // only one writer of the generated list files at a time
+	generatedListWrites        sync.WaitGroup // background writes to the generated list files, waited for on shutdown
 	log                        *logger.Logger
 	auditBlockedNumbers        *os.File
 	auditBlockedNumbersCSV     *csv.Writer
@@ -37,18 +47,47 @@ type spamFilter struct {
 	auditAllowedNumbersCSV     *csv.Writer
 	auditWhitelistedNumbers    *os.File
 	auditWhitelistedNumbersCSV *csv.Writer
+	auditWithheldNumbers       *os.File
+	auditWithheldNumbersCSV    *csv.Writer
+	auditGreylistedNumbers     *os.File
+	auditGreylistedNumbersCSV  *csv.Writer
+	auditChallengedNumbers     *os.File
+	auditChallengedNumbersCSV  *csv.Writer
 	auditFileSIGHUPLock        sync.RWMutex
 	stats                      *stats
+	numberingPlan              *numberingPlan
 }
 
 type numberList struct {
 	fileName string
-	numbers  map[string]number
+	numbers  []number // exact numbers
+	prefixes []number // prefixes, ending with *
+	ranges   numberRanges
+	regexes  []numberRegex
+	// the state of the file when it was parsed, so that only changed files are parsed again on reload
+	fileSize int64
+	modTime  time.Time
+	hash     []byte // sha256 of the content, nil if not known
 }
 
 type number struct {
+	number     string // the number, prefix, range or regex, as written in the list file
 	lineNumber int
 	comment    string
+	attributes *entryAttributes // nil if the entry has no attributes
+}
+
+type numberRegex struct {
+	regex *regexp.Regexp
+	entry number
+}
+
+func (n *number) prefix() string {
+	return strings.TrimSuffix(n.number, "*")
+}
+
+func (l *numberList) size() int {
+	return len(l.numbers) + len(l.prefixes) + len(l.ranges) + len(l.regexes)
 }
 
 func Run(config *SpamFilterConfig, log *logger.Logger) error {
@@ -68,15 +107,53 @@ func Run(config *SpamFilterConfig, log *logger.Logger) error {
 	// patch zerolog to use the logger
 	cfg.initPatchZerolog()
 
+	// initialize the numbering plan
+	numberingPlan, err := newNumberingPlan(cfg.config.CountryCode, cfg.config.NumberingPlan)
+	if err != nil {
+		return err
+	}
+	cfg.numberingPlan = numberingPlan
+
+	// validate the spam settings, and create the list sets of the DIDs
+	err = cfg.initListSets()
+	if err != nil {
+		return err
+	}
+
 	// initialize the stats system
 	cfg.initStats()
 
+	// load the greylist
+	err = cfg.initGreylist()
+	if err != nil {
+		return err
+	}
+
+	// forget the callers of the auto blacklist which did not call within the window
+	cfg.initCallRatePruning()
+
+	// delete old voicemail recordings
+	cfg.initVoicemailRetention()
+
+	// fetch the remote lists
+	err = cfg.initRemoteLists()
+	if err != nil {
+		return err
+	}
+
 	// parse the blacklists
 	log.Info("Parsing blacklists")
-	err := cfg.parseNumberLists()
+	err = cfg.reload("startup")
 	if err != nil {
 		return err
 	}
+	cfg.initReloadQueue()
+	cfg.startRemoteListRefresh()
+
+	// watch the list files for changes
+	if cfg.config.Spam.AutoReload {
+		cfg.initListWatcher()
+	}
 
 	// open the audit files
 	log.Info("Opening audit files")
@@ -222,6 +299,12 @@ func (cfg *spamFilter) initSignalHandlers(client *sipgo.Client, ua *sipgo.UserAg
 		client.Close()
 		ua.Close()
 		cfg.closeAuditFiles(true)
+		cfg.generatedListWrites.Wait()
+		if cfg.greylist != nil {
+			if err := cfg.greylist.write(); err != nil {
+				cfg.log.Warn("Could not write greylist file %s: %v", cfg.greylist.fileName, err)
+			}
+		}
 		exiter <- nil
 	}()
 	go func() {
@@ -229,12 +312,7 @@ func (cfg *spamFilter) initSignalHandlers(client *sipgo.Client, ua *sipgo.UserAg
 		signal.Notify(sigUsr1Chan, syscall.SIGUSR1)
 		for {
 			<-sigUsr1Chan
-			cfg.log.Info("SIGUSR1: Reloading blacklists")
-			if err := cfg.parseNumberLists(); err != nil {
-				cfg.log.Error("Error reloading blacklists: %v", err)
-			} else {
-				cfg.log.Info("SIGUSR1: Blacklists reloaded")
-			}
+			cfg.requestReload("SIGUSR1")
 		}
 	}()
 	go func() {
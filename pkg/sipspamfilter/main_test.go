@@ -2,7 +2,13 @@ package sipspamfilter
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rglonek/logger"
 )
@@ -12,12 +18,13 @@ func BenchmarkBlacklistLookup(b *testing.B) {
 	numbersPerFile := 1000
 	bln := []*numberList{}
 	for i := 0; i < testFileCount; i++ {
-		numbers := make(map[string]number)
+		numbers := []number{}
 		for j := 0; j < numbersPerFile; j++ {
-			numbers[fmt.Sprintf("+447501234567%d", j)] = number{
+			numbers = append(numbers, number{
+				number:     fmt.Sprintf("+447501234567%d", j),
 				lineNumber: j,
 				comment:    fmt.Sprintf("some long-add comment explaining why this number is blacklisted-%d", j),
-			}
+			})
 		}
 		bln = append(bln, &numberList{
 			fileName: fmt.Sprintf("./blacklist/blacklist-file-name-long-%d.txt", i),
@@ -25,12 +32,300 @@ func BenchmarkBlacklistLookup(b *testing.B) {
 		})
 	}
 	cfg := &spamFilter{
-		blacklistNumbers: bln,
-		stats:            &stats{},
+		lists: listSet{blacklistNumbers: newNumberIndex(bln)},
+		stats: &stats{},
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		cfg.isSpam("+447501234568")
+		cfg.isSpam(&cfg.lists, "+447501234568")
 	}
 	cfg.stats.print(logger.NewLogger())
 }
+
+func TestLookupPrecedence(t *testing.T) {
+	exact := &numberList{
+		fileName: "exact.txt",
+		numbers: []number{
+			{number: "+447871000001", lineNumber: 1, comment: "exact"},
+		},
+	}
+	exact2 := &numberList{
+		fileName: "exact2.txt",
+		numbers: []number{
+			{number: "+447871000001", lineNumber: 5, comment: "exact"},
+		},
+	}
+	prefixes := &numberList{
+		fileName: "prefixes.txt",
+		prefixes: []number{
+			{number: "+44787*", lineNumber: 1, comment: "short"},
+			{number: "+447871*", lineNumber: 2, comment: "long"},
+		},
+		ranges: numberRanges{
+			{start: "+447873000000", end: "+447873999999", entry: number{number: "+447873000000-+447873999999", lineNumber: 3}},
+		},
+	}
+	ranges := &numberList{
+		fileName: "ranges.txt",
+		ranges: numberRanges{
+			{start: "+447873500000", end: "+447873500099", entry: number{number: "+447873500000-+447873500099", lineNumber: 1}},
+			{start: "+447874000000", end: "+447874000099", entry: number{number: "+447874000000-+447874000099", lineNumber: 2}},
+		},
+	}
+	regexes := &numberList{
+		fileName: "regexes.regex",
+		regexes: []numberRegex{
+			{regex: regexp.MustCompile(`^(?:\+4478(6{8}|7{8}))$`), entry: number{number: `\+4478(6{8}|7{8})`, lineNumber: 1}},
+		},
+	}
+	idx := newNumberIndex([]*numberList{prefixes, exact, ranges, exact2, regexes})
+	tests := []struct {
+		callerID string
+		matches  []string
+	}{
+		{"+447871000001", []string{"exact.txt:1", "exact2.txt:5"}},
+		{"+447871000002", []string{"prefixes.txt:2"}},
+		{"+447872000002", []string{"prefixes.txt:1"}},
+		{"+447873500050", []string{"prefixes.txt:3", "ranges.txt:1"}},
+		{"+447873500150", []string{"prefixes.txt:3"}},
+		{"+447874000050", []string{"ranges.txt:2"}},
+		{"+447866666666", []string{"regexes.regex:1"}},
+		{"+447871111111", []string{"prefixes.txt:2"}},
+		{"+447770000000", nil},
+	}
+	for _, test := range tests {
+		got := []string{}
+		for _, match := range idx.lookup(test.callerID) {
+			got = append(got, fmt.Sprintf("%s:%d", match.list.fileName, match.entry.lineNumber))
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(test.matches, ",") {
+			t.Errorf("%s: expected %v, got %v", test.callerID, test.matches, got)
+		}
+	}
+}
+
+func TestNumberRanges(t *testing.T) {
+	ranges := numberRanges{}
+	for i, line := range []string{"+441632960000-+441632960999", "+441632960500-+441632961500", "+4420-+4429", "+441632970000-+441632970000", "+441632960000-+441632960999"} {
+		start, end, err := parseNumberRange(line)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		ranges = append(ranges, numberRange{start: start, end: end, entry: number{number: line, lineNumber: i + 1}})
+	}
+	overlaps, duplicates := 0, 0
+	ranges = ranges.sortAndCheckOverlaps(func(cur numberRange, previous numberRange, duplicate bool) {
+		if duplicate {
+			duplicates++
+			if cur.entry.lineNumber != 5 || previous.entry.lineNumber != 1 {
+				t.Errorf("expected the duplicate on line 5 to be dropped, got line %d", cur.entry.lineNumber)
+			}
+			return
+		}
+		overlaps++
+		if cur.entry.lineNumber != 2 || previous.entry.lineNumber != 1 {
+			t.Errorf("expected line 2 to overlap line 1, got line %d overlapping line %d", cur.entry.lineNumber, previous.entry.lineNumber)
+		}
+	})
+	if overlaps != 1 || duplicates != 1 || len(ranges) != 4 {
+		t.Fatalf("expected 1 overlapping range kept, 1 duplicate range dropped and 4 kept, got %d overlapping, %d duplicates and %d kept", overlaps, duplicates, len(ranges))
+	}
+
+	// overlapping ranges both match, the first in the file first; numbers covered by one of them only still match
+	idx := newNumberIndex([]*numberList{{fileName: "ranges.txt", ranges: ranges}})
+	for callerID, lines := range map[string][]int{"+441632960100": {1}, "+441632960600": {1, 2}, "+441632961200": {2}, "+441632961600": nil} {
+		got := []int{}
+		for _, match := range idx.lookup(callerID) {
+			got = append(got, match.entry.lineNumber)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(append([]int{}, lines...)) {
+			t.Errorf("%s: expected matches on lines %v, got %v", callerID, lines, got)
+		}
+	}
+	tests := map[string]int{
+		"+441632960000": 1,
+		"+441632960999": 1,
+		"+441632961000": 2,
+		"+441632970000": 4,
+		"+4425":         3,
+		"+44250":        0,
+		"+441632959999": 0,
+	}
+	for callerID, lineNo := range tests {
+		matches := idx.lookup(callerID)
+		if (len(matches) == 0 && lineNo != 0) || (len(matches) > 0 && matches[0].entry.lineNumber != lineNo) {
+			t.Errorf("%s: expected line %d, got %v", callerID, lineNo, matches)
+		}
+	}
+	for _, line := range []string{"+4412-+44123", "+4419-+4410", "+44a1-+44a2", "+441-+442-+443"} {
+		if _, _, err := parseNumberRange(line); err == nil {
+			t.Errorf("%s: expected error", line)
+		}
+	}
+	// only a single - between two numbers is a range, other entries are numbers written with separators
+	for entry, isRange := range map[string]bool{"+4420-+4429": true, "+4420 - +4429": true, "+1-555-0100": false, "+4420-": false, "+44a1-+44a2": false} {
+		if isNumberRange(entry) != isRange {
+			t.Errorf("%s: expected range to be %t", entry, isRange)
+		}
+	}
+}
+
+func TestEntryAttributes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blacklist.txt")
+	content := "+447000000001 # no attributes\n#! action=reject code=404\n+447000000002\n+447000000003 code=603 hangup_delay=5s # overrides the code\n+44871* action=hangup bogus=1\n+447000000004 reason=\"Go Away\"\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &spamFilter{config: &SpamFilterConfig{}, log: logger.NewLogger()}
+	cfg.log.SetLogLevel(logger.ERROR)
+	list, err := cfg.parseFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := newNumberIndex([]*numberList{list})
+	defaults := blockAction{action: "hangup", code: 486}
+	tests := map[string]blockAction{
+		"+447000000001": defaults,
+		"+447000000002": {action: "reject", code: 404},
+		"+447000000003": {action: "reject", code: 603, hangupDelay: 5 * time.Second},
+		"+448710000000": {action: "hangup", code: 404},
+		"+447000000004": {action: "reject", code: 404, reason: "Go Away"},
+	}
+	for callerID, expected := range tests {
+		matches := idx.lookup(callerID)
+		if len(matches) != 1 {
+			t.Fatalf("%s: expected 1 match, got %d", callerID, len(matches))
+		}
+		if got := matches[0].entry.attributes.apply(defaults); got != expected {
+			t.Errorf("%s: expected %+v, got %+v", callerID, expected, got)
+		}
+	}
+	if matches := idx.lookup("+448710000000"); matches[0].entry.attributes.String() != "action=reject code=404 action=hangup" {
+		t.Errorf("unexpected raw attributes %q", matches[0].entry.attributes.String())
+	}
+
+	// the attributes are the key=value words at the end of the line, the words before them are the entry
+	for text, expected := range map[string]listLine{
+		"+447000000001 action=reject code=486 # comment": {entry: "+447000000001", attributes: "action=reject code=486", comment: "comment"},
+		"+44 700 000 0001 action=reject":                 {entry: "+44 700 000 0001", attributes: "action=reject"},
+		"+44 700 000 0001\taction=reject notes=\"a b\"":  {entry: "+44 700 000 0001", attributes: "action=reject notes=\"a b\""},
+		"+44 700 000 0001 # no attributes":               {entry: "+44 700 000 0001", comment: "no attributes"},
+		"+447000000001 action=reject bogus":              {entry: "+447000000001 action=reject bogus"},
+		"action=reject":                                  {entry: "action=reject"},
+	} {
+		if line, ok := parseListLine(text); !ok || line != expected {
+			t.Errorf("%q: expected %+v, got %+v", text, expected, line)
+		}
+	}
+}
+
+func TestExpiringEntries(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "blacklist.txt")
+	content := "# campaign numbers\n#! ttl=30d\n+447000000001 added=2020-01-01 # expired\n+447000000002 added=2999-01-01\n+44700* expires=2020-12-31\n+4470* # still active\n+447000000003 expires=2999-12-31\n+447000000004 ttl=1d # no added date\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &spamFilter{
+		config: &SpamFilterConfig{Spam: SpamFilterSpam{BlacklistPaths: []string{dir}}},
+		log:    logger.NewLogger(),
+	}
+	cfg.log.SetLogLevel(logger.ERROR)
+	list, err := cfg.parseFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := newNumberIndex([]*numberList{list})
+	tests := map[string]int{
+		"+447000000001": 6, // the expired exact entry and prefix are skipped
+		"+447000000002": 4,
+		"+447000000003": 7,
+		"+447000000004": 8,
+		"+447000000005": 6,
+	}
+	for callerID, line := range tests {
+		matches := idx.lookup(callerID)
+		if len(matches) != 1 || matches[0].entry.lineNumber != line {
+			t.Errorf("%s: expected a match on line %d, got %d matches", callerID, line, len(matches))
+		}
+	}
+	if expired := idx.expiredEntries(time.Now()); expired[file] != 2 {
+		t.Errorf("expected 2 expired entries, got %d", expired[file])
+	}
+
+	if err := Prune(cfg.config, cfg.log, false); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# campaign numbers\n#! ttl=30d\n+447000000002 added=2999-01-01\n+4470* # still active\n+447000000003 expires=2999-12-31\n+447000000004 ttl=1d # no added date\n"
+	if string(pruned) != expected {
+		t.Errorf("unexpected pruned file:\n%s", pruned)
+	}
+}
+
+func TestIncrementalReload(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		dir := t.TempDir()
+		write := func(name string, content string) {
+			t.Helper()
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		write("a.txt", "+447000000001\n")
+		write("b.txt", "+447000000002\n")
+		write("c.txt", "+447000000003 # unchanged\n+44873*\n")
+		cfg := &spamFilter{
+			config: &SpamFilterConfig{Spam: SpamFilterSpam{CompactIndex: compact}},
+			log:    logger.NewLogger(),
+		}
+		cfg.log.SetLogLevel(logger.ERROR)
+		first, err := cfg.loadNumberIndex("blacklist", []string{dir}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Remove(filepath.Join(dir, "a.txt"))
+		write("b.txt", "+447000000004\n")
+		write("c.txt", "+447000000003 # unchanged\n+44873*\n") // same content, new modification time
+		write("d.txt", "+447000000005\n")
+		future := time.Now().Add(time.Hour)
+		os.Chtimes(filepath.Join(dir, "b.txt"), future, future)
+		os.Chtimes(filepath.Join(dir, "c.txt"), future, future)
+		second, err := cfg.loadNumberIndex("blacklist", []string{dir}, first)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lists := map[string]*numberList{}
+		for _, list := range first.lists {
+			lists[filepath.Base(list.fileName)] = list
+		}
+		for _, list := range second.lists {
+			name := filepath.Base(list.fileName)
+			if reused := list == lists[name]; reused != (name == "c.txt") {
+				t.Errorf("compact=%v: %s: expected reused=%v, got %v", compact, name, name == "c.txt", reused)
+			}
+		}
+		tests := map[string]bool{
+			"+447000000001": false,
+			"+447000000002": false,
+			"+447000000003": true,
+			"+448730000000": true,
+			"+447000000004": true,
+			"+447000000005": true,
+		}
+		for callerID, found := range tests {
+			if matches := second.lookup(callerID); (matches != nil) != found {
+				t.Errorf("compact=%v: %s: expected found=%v", compact, callerID, found)
+			}
+		}
+		if matches := second.lookup("+447000000003"); len(matches) != 1 || matches[0].entry.comment != "unchanged" {
+			t.Errorf("compact=%v: unchanged file entry not copied", compact)
+		}
+	}
+}
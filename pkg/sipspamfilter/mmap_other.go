@@ -0,0 +1,17 @@
+//go:build !unix
+
+package sipspamfilter
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile reads the whole file into memory on platforms without mmap support
+func mmapFile(f *os.File, size int) (data []byte, unmap func() error, err error) {
+	data = make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,242 @@
+package sipspamfilter
+
+import (
+	"sort"
+	"time"
+)
+
+// numberIndex is the merged lookup index of all list files of a blacklist or whitelist, built on each reload,
+// so that the lookup cost does not depend on the number of list files
+type numberIndex struct {
+	lists    []*numberList
+	numbers  map[string][]listMatch
+	prefixes prefixTrie
+	ranges   []indexRange
+	regexes  []indexRegex
+	compact  *compactIndex     // exact numbers, if compact_index is enabled
+	changes  map[string]string // how each list file changed compared to the previous index, by file name
+}
+
+// listMatch references the list file entry a number matched
+type listMatch struct {
+	list  *numberList
+	entry *number
+}
+
+type indexRange struct {
+	listMatch
+	numberRange *numberRange
+	maxEnd      string // largest range end of this range and all preceding ranges of the same length
+	file        int    // position of the list in lists, so that overlapping ranges are returned in file and line order
+}
+
+type indexRegex struct {
+	listMatch
+	numberRegex *numberRegex
+}
+
+func newNumberIndex(lists []*numberList) *numberIndex {
+	idx := &numberIndex{
+		lists:   lists,
+		numbers: make(map[string][]listMatch),
+	}
+	for file, list := range lists {
+		for i := range list.numbers {
+			entry := &list.numbers[i]
+			idx.numbers[entry.number] = append(idx.numbers[entry.number], listMatch{list, entry})
+		}
+		for i := range list.prefixes {
+			entry := &list.prefixes[i]
+			idx.prefixes.insert(entry.prefix(), listMatch{list, entry})
+		}
+		for i := range list.ranges {
+			r := &list.ranges[i]
+			idx.ranges = append(idx.ranges, indexRange{
+				listMatch:   listMatch{list, &r.entry},
+				numberRange: r,
+				file:        file,
+			})
+		}
+		for i := range list.regexes {
+			r := &list.regexes[i]
+			idx.regexes = append(idx.regexes, indexRegex{
+				listMatch:   listMatch{list, &r.entry},
+				numberRegex: r,
+			})
+		}
+	}
+	// ranges from different files may overlap, so track the largest end seen so far to know how far back to search
+	sort.SliceStable(idx.ranges, func(i, j int) bool {
+		a, b := idx.ranges[i].numberRange, idx.ranges[j].numberRange
+		if len(a.start) != len(b.start) {
+			return len(a.start) < len(b.start)
+		}
+		return a.start < b.start
+	})
+	for i := range idx.ranges {
+		idx.ranges[i].maxEnd = idx.ranges[i].numberRange.end
+		if i > 0 && len(idx.ranges[i-1].numberRange.start) == len(idx.ranges[i].numberRange.start) && idx.ranges[i-1].maxEnd > idx.ranges[i].maxEnd {
+			idx.ranges[i].maxEnd = idx.ranges[i-1].maxEnd
+		}
+	}
+	return idx
+}
+
+// lookup returns all list entries matching the callerID; exact entries in any list take precedence over ranges, ranges take precedence
+// over prefixes, and the longest matching prefix wins; regexes are evaluated last
+//
+// Expired entries are ignored, as if they were not in the list. The returned slice must not be modified.
+func (idx *numberIndex) lookup(callerID string) []listMatch {
+	if idx == nil {
+		return nil
+	}
+	if idx.compact != nil {
+		if matches := activeMatches(idx.compact.lookup(idx.lists, callerID)); matches != nil {
+			return matches
+		}
+	}
+	if matches := activeMatches(idx.numbers[callerID]); matches != nil {
+		return matches
+	}
+	if matches := activeMatches(idx.lookupRanges(callerID)); matches != nil {
+		return matches
+	}
+	if matches, _ := idx.prefixes.longestMatch(callerID); matches != nil {
+		return matches
+	}
+	var matches []listMatch
+	for _, r := range idx.regexes {
+		if r.numberRegex.regex.MatchString(callerID) {
+			matches = append(matches, r.listMatch)
+		}
+	}
+	return activeMatches(matches)
+}
+
+// activeMatches returns the matches which have not expired, or nil if there are none
+func activeMatches(matches []listMatch) []listMatch {
+	var now time.Time
+	for i, match := range matches {
+		if match.entry.attributes.expiry().IsZero() {
+			continue
+		}
+		if now.IsZero() {
+			now = time.Now()
+		}
+		if !match.entry.attributes.expired(now) {
+			continue
+		}
+		// copy the active matches, as the slice belongs to the index
+		active := append([]listMatch{}, matches[:i]...)
+		for _, match := range matches[i+1:] {
+			if !match.entry.attributes.expired(now) {
+				active = append(active, match)
+			}
+		}
+		if len(active) == 0 {
+			return nil
+		}
+		return active
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	return matches
+}
+
+// lookupRanges returns the ranges containing the callerID, ordered by file and line, so that the first match is the first range of the first file
+func (idx *numberIndex) lookupRanges(callerID string) (matches []listMatch) {
+	i := sort.Search(len(idx.ranges), func(i int) bool {
+		start := idx.ranges[i].numberRange.start
+		if len(start) != len(callerID) {
+			return len(start) > len(callerID)
+		}
+		return start > callerID
+	})
+	found := []*indexRange{}
+	for i--; i >= 0 && len(idx.ranges[i].numberRange.start) == len(callerID) && idx.ranges[i].maxEnd >= callerID; i-- {
+		if idx.ranges[i].numberRange.end >= callerID {
+			found = append(found, &idx.ranges[i])
+		}
+	}
+	if len(found) > 1 {
+		sort.Slice(found, func(i, j int) bool {
+			if found[i].file != found[j].file {
+				return found[i].file < found[j].file
+			}
+			return found[i].entry.lineNumber < found[j].entry.lineNumber
+		})
+	}
+	for _, r := range found {
+		matches = append(matches, r.listMatch)
+	}
+	return matches
+}
+
+// expiredEntries returns the number of expired entries by list file name
+func (idx *numberIndex) expiredEntries(now time.Time) map[string]int {
+	expired := make(map[string]int)
+	if idx == nil {
+		return expired
+	}
+	check := func(list *numberList, entry *number) {
+		if entry.attributes.expired(now) {
+			expired[list.fileName]++
+		}
+	}
+	for _, list := range idx.lists {
+		for i := range list.numbers {
+			check(list, &list.numbers[i])
+		}
+		for i := range list.prefixes {
+			check(list, &list.prefixes[i])
+		}
+		for i := range list.ranges {
+			check(list, &list.ranges[i].entry)
+		}
+		for i := range list.regexes {
+			check(list, &list.regexes[i].entry)
+		}
+	}
+	if idx.compact != nil {
+		idx.compact.expiredEntries(idx.lists, now, expired)
+	}
+	return expired
+}
+
+// fileEntries returns the number of entries of each list file, in the order of the lists
+func (idx *numberIndex) fileEntries() []int {
+	entries := make([]int, len(idx.lists))
+	for i, list := range idx.lists {
+		entries[i] = list.size()
+	}
+	if idx.compact != nil {
+		for _, e := range idx.compact.entries {
+			entries[e.file]++
+		}
+	}
+	return entries
+}
+
+// size returns the number of entries in the index
+func (idx *numberIndex) size() int {
+	if idx == nil {
+		return 0
+	}
+	size := 0
+	for _, list := range idx.lists {
+		size += list.size()
+	}
+	if idx.compact != nil {
+		size += len(idx.compact.numbers)
+	}
+	return size
+}
+
+// close releases the memory-mapped index file, if any; the index must not be used afterwards
+func (idx *numberIndex) close() error {
+	if idx == nil || idx.compact == nil {
+		return nil
+	}
+	return idx.compact.close()
+}
@@ -0,0 +1,111 @@
+package sipspamfilter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// numberRange is an inclusive range of numbers of equal length, such as +441632960000-+441632960999
+type numberRange struct {
+	start string
+	end   string
+	entry number
+}
+
+// numberRanges is a list of ranges, sorted by number length and then by range start; ranges may overlap
+type numberRanges []numberRange
+
+// isNumberRange returns true if the entry is a range: a single - between two numbers, each digits with an optional leading +; other entries
+// containing a -, such as +1-555-0100, are not ranges
+func isNumberRange(entry string) bool {
+	start, end, ok := strings.Cut(entry, "-")
+	return ok && isNumber(strings.TrimSpace(start)) && isNumber(strings.TrimSpace(end))
+}
+
+func isNumber(n string) bool {
+	n = strings.TrimPrefix(n, "+")
+	if n == "" {
+		return false
+	}
+	for _, c := range n {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNumberRange parses a start-end range line; start and end must have the same length, and start must not be larger than end
+func parseNumberRange(line string) (start string, end string, err error) {
+	rangeSplit := strings.Split(line, "-")
+	if len(rangeSplit) != 2 {
+		return "", "", fmt.Errorf("range must be in the format start-end")
+	}
+	start = strings.TrimSpace(rangeSplit[0])
+	end = strings.TrimSpace(rangeSplit[1])
+	if start == "" || end == "" {
+		return "", "", fmt.Errorf("range must be in the format start-end")
+	}
+	if len(start) != len(end) {
+		return "", "", fmt.Errorf("range start and end must have the same number of digits")
+	}
+	if strings.HasPrefix(start, "+") != strings.HasPrefix(end, "+") {
+		return "", "", fmt.Errorf("range start and end must either both or neither start with +")
+	}
+	for _, n := range []string{start, end} {
+		for _, c := range strings.TrimPrefix(n, "+") {
+			if c < '0' || c > '9' {
+				return "", "", fmt.Errorf("range may only contain digits")
+			}
+		}
+	}
+	if start > end {
+		return "", "", fmt.Errorf("range start is larger than range end")
+	}
+	return start, end, nil
+}
+
+func (r numberRanges) less(i, j int) bool {
+	if len(r[i].start) != len(r[j].start) {
+		return len(r[i].start) < len(r[j].start)
+	}
+	if r[i].start != r[j].start {
+		return r[i].start < r[j].start
+	}
+	return r[i].end < r[j].end
+}
+
+// sortAndCheckOverlaps sorts the ranges and removes duplicate ranges, keeping the range which appeared first in the file; ranges which only
+// partially overlap are kept, as each matches numbers the other does not. The callback is called for each range overlapping an earlier range
+// of the file, with duplicate set if the range was removed
+func (r numberRanges) sortAndCheckOverlaps(onOverlap func(cur numberRange, previous numberRange, duplicate bool)) numberRanges {
+	sort.SliceStable(r, r.less)
+	ret := r[:0]
+	var last *numberRange // the range with the largest end so far, of the current length
+	for _, cur := range r {
+		if last == nil || len(last.start) != len(cur.start) || cur.start > last.end {
+			ret = append(ret, cur)
+			last = &ret[len(ret)-1]
+			continue
+		}
+		// duplicates are next to each other once sorted
+		if prev := &ret[len(ret)-1]; cur.start == prev.start && cur.end == prev.end {
+			if cur.entry.lineNumber < prev.entry.lineNumber {
+				cur, *prev = *prev, cur
+			}
+			onOverlap(cur, *prev, true)
+			continue
+		}
+		first, second := *last, cur
+		if second.entry.lineNumber < first.entry.lineNumber {
+			first, second = second, first
+		}
+		onOverlap(second, first, false)
+		ret = append(ret, cur)
+		if cur.end > last.end {
+			last = &ret[len(ret)-1]
+		}
+	}
+	return ret
+}
@@ -0,0 +1,205 @@
+package sipspamfilter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// numberingPlan describes how numbers are dialled within a country, used to convert caller IDs to E.164 format
+type numberingPlan struct {
+	countryCode           string
+	internationalPrefixes []string // international access codes, such as 00 or 011
+	trunkPrefix           string   // national trunk prefix, such as 0 or 1; empty if the country does not use one
+	keepTrunkPrefix       bool     // if set, the trunk prefix is part of the number in E.164 format (for example Italy)
+	nationalLengths       []int    // valid lengths of national numbers, excluding the trunk prefix unless it is kept; if empty, all lengths are valid
+}
+
+// numberingPlans are the built-in numbering plans, by country code; other country codes use defaultNumberingPlan
+var numberingPlans = map[string]numberingPlan{
+	"1":   {internationalPrefixes: []string{"011"}, trunkPrefix: "1", nationalLengths: []int{10}},
+	"31":  {internationalPrefixes: []string{"00"}, trunkPrefix: "0", nationalLengths: []int{9}},
+	"33":  {internationalPrefixes: []string{"00"}, trunkPrefix: "0", nationalLengths: []int{9}},
+	"34":  {internationalPrefixes: []string{"00"}, nationalLengths: []int{9}},
+	"39":  {internationalPrefixes: []string{"00"}, trunkPrefix: "0", keepTrunkPrefix: true, nationalLengths: []int{6, 7, 8, 9, 10, 11}},
+	"44":  {internationalPrefixes: []string{"00"}, trunkPrefix: "0", nationalLengths: []int{9, 10}},
+	"48":  {internationalPrefixes: []string{"00"}, nationalLengths: []int{9}},
+	"49":  {internationalPrefixes: []string{"00"}, trunkPrefix: "0", nationalLengths: []int{6, 7, 8, 9, 10, 11}},
+	"61":  {internationalPrefixes: []string{"0011"}, trunkPrefix: "0", nationalLengths: []int{9}},
+	"353": {internationalPrefixes: []string{"00"}, trunkPrefix: "0", nationalLengths: []int{7, 8, 9}},
+}
+
+var defaultNumberingPlan = numberingPlan{
+	internationalPrefixes: []string{"00"},
+	trunkPrefix:           "0",
+}
+
+// newNumberingPlan returns the numbering plan for the country code, with the overrides from the config applied
+func newNumberingPlan(countryCode string, override *SpamFilterNumberingPlan) (*numberingPlan, error) {
+	if countryCode == "" || strings.Trim(countryCode, "0123456789") != "" {
+		return nil, fmt.Errorf("invalid country code %q, it should only contain digits", countryCode)
+	}
+	plan, ok := numberingPlans[countryCode]
+	if !ok {
+		plan = defaultNumberingPlan
+	}
+	plan.countryCode = countryCode
+	if override != nil {
+		if override.InternationalPrefixes != nil {
+			plan.internationalPrefixes = override.InternationalPrefixes
+		}
+		if override.TrunkPrefix != nil {
+			plan.trunkPrefix = *override.TrunkPrefix
+		}
+		if override.KeepTrunkPrefix != nil {
+			plan.keepTrunkPrefix = *override.KeepTrunkPrefix
+		}
+		if override.NationalLengths != nil {
+			plan.nationalLengths = override.NationalLengths
+		}
+	}
+	// check longer international prefixes first, so that 0011 is not mistaken for 00
+	plan.internationalPrefixes = append([]string{}, plan.internationalPrefixes...)
+	sort.Slice(plan.internationalPrefixes, func(i, j int) bool {
+		return len(plan.internationalPrefixes[i]) > len(plan.internationalPrefixes[j])
+	})
+	return &plan, nil
+}
+
+func (p *numberingPlan) isNationalLength(n string) bool {
+	if len(p.nationalLengths) == 0 {
+		return true
+	}
+	for _, l := range p.nationalLengths {
+		if len(n) == l {
+			return true
+		}
+	}
+	return false
+}
+
+// toInternational converts a dialled number to E.164 format; phoneContext is the phone-context of the URI, if any
+//
+// Numbers which are not numeric (such as anonymous) and numbers which are not valid national numbers (such as short codes)
+// are returned without conversion.
+func (p *numberingPlan) toInternational(callerID string, phoneContext string) string {
+	callerID = stripVisualSeparators(callerID)
+	// + is good
+	if strings.HasPrefix(callerID, "+") {
+		return callerID
+	}
+	if strings.Trim(callerID, "0123456789") != "" || callerID == "" {
+		return callerID
+	}
+
+	// a global phone-context (for example +44) means the number is local to that prefix
+	if strings.HasPrefix(phoneContext, "+") {
+		context := stripVisualSeparators(phoneContext)
+		if p.trunkPrefix != "" && !p.keepTrunkPrefix && strings.HasPrefix(context, "+"+p.countryCode) {
+			callerID = strings.TrimPrefix(callerID, p.trunkPrefix)
+		}
+		return context + callerID
+	}
+
+	// international access code - replace with +
+	for _, prefix := range p.internationalPrefixes {
+		if prefix != "" && strings.HasPrefix(callerID, prefix) {
+			return "+" + callerID[len(prefix):]
+		}
+	}
+
+	// trunk prefix - national number
+	if p.trunkPrefix != "" && strings.HasPrefix(callerID, p.trunkPrefix) {
+		national := callerID
+		if !p.keepTrunkPrefix {
+			national = callerID[len(p.trunkPrefix):]
+		}
+		if p.isNationalLength(national) {
+			return "+" + p.countryCode + national
+		}
+	}
+
+	// national number dialled without the trunk prefix
+	if len(p.nationalLengths) > 0 && p.isNationalLength(callerID) {
+		return "+" + p.countryCode + callerID
+	}
+
+	// if it starts with the country code, add a plus
+	if strings.HasPrefix(callerID, p.countryCode) && p.isNationalLength(callerID[len(p.countryCode):]) {
+		return "+" + callerID
+	}
+
+	// without known national lengths, assume all other numbers are national
+	if len(p.nationalLengths) == 0 {
+		return "+" + p.countryCode + callerID
+	}
+
+	// short codes and service numbers are left as they are
+	return callerID
+}
+
+// prefixToInternational converts a dialled number prefix to E.164 format; unlike numbers, the length of prefixes is not known,
+// so only prefixes starting with an international access code or the trunk prefix are converted
+func (p *numberingPlan) prefixToInternational(prefix string) string {
+	prefix = stripVisualSeparators(prefix)
+	if strings.HasPrefix(prefix, "+") || strings.Trim(prefix, "0123456789") != "" {
+		return prefix
+	}
+	for _, international := range p.internationalPrefixes {
+		if international != "" && strings.HasPrefix(prefix, international) {
+			return "+" + prefix[len(international):]
+		}
+	}
+	if p.trunkPrefix != "" && strings.HasPrefix(prefix, p.trunkPrefix) {
+		if p.keepTrunkPrefix {
+			return "+" + p.countryCode + prefix
+		}
+		return "+" + p.countryCode + prefix[len(p.trunkPrefix):]
+	}
+	return prefix
+}
+
+// uriToInternational extracts the number from a sip: or tel: URI and converts it to E.164 format
+func (p *numberingPlan) uriToInternational(uri sip.Uri) (original string, international string) {
+	original = uri.User
+	phoneContext := ""
+	if strings.EqualFold(uri.Scheme, "tel") {
+		// tel:+441234567890;phone-context=... is parsed with the number as the host
+		original = uri.Host
+		phoneContext = uriParam(uri.UriParams, "phone-context")
+	}
+	// sip:01234567890;phone-context=+44@host;user=phone carries the parameters in the user part
+	if i := strings.Index(original, ";"); i >= 0 {
+		for _, param := range strings.Split(original[i+1:], ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(key, "phone-context") {
+				phoneContext = value
+			}
+		}
+		original = original[:i]
+	}
+	return original, p.toInternational(original, phoneContext)
+}
+
+func uriParam(params sip.HeaderParams, name string) string {
+	for key, value := range params {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// stripVisualSeparators removes the visual separators allowed in tel: URIs (RFC 3966) and commonly used to group the digits of caller IDs and
+// list entries, such as +1-555-0100 or +44 7700 900123
+func stripVisualSeparators(n string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', '.', '(', ')', ' ':
+			return -1
+		}
+		return r
+	}, n)
+}
@@ -0,0 +1,67 @@
+package sipspamfilter
+
+import (
+	"testing"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestNumberingPlans(t *testing.T) {
+	tests := []struct {
+		countryCode string
+		callerID    string
+		expected    string
+	}{
+		{"44", "+447912345678", "+447912345678"},
+		{"44", "00447912345678", "+447912345678"},
+		{"44", "07912345678", "+447912345678"},
+		{"44", "7912345678", "+447912345678"},
+		{"44", "447912345678", "+447912345678"},
+		{"44", "999", "999"},
+		{"44", "anonymous", "anonymous"},
+		{"1", "2125551234", "+12125551234"},
+		{"1", "12125551234", "+12125551234"},
+		{"1", "011447912345678", "+447912345678"},
+		{"1", "(212) 555-1234", "+12125551234"},
+		{"1", "911", "911"},
+		{"39", "0612345678", "+390612345678"},
+		{"39", "3912345678", "+393912345678"},
+		{"39", "00447912345678", "+447912345678"},
+		{"61", "0011447912345678", "+447912345678"},
+		{"61", "0412345678", "+61412345678"},
+		{"420", "0123456789", "+420123456789"},
+		{"420", "123456789", "+420123456789"},
+	}
+	for _, test := range tests {
+		plan, err := newNumberingPlan(test.countryCode, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := plan.toInternational(test.callerID, ""); got != test.expected {
+			t.Errorf("country code %s: %s: expected %s, got %s", test.countryCode, test.callerID, test.expected, got)
+		}
+	}
+}
+
+func TestNumberingPlanURIs(t *testing.T) {
+	plan, err := newNumberingPlan("44", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"sip:07912345678@example.com":                              "+447912345678",
+		"tel:+44-7912-345678":                                      "+447912345678",
+		"tel:2125551234;phone-context=+1":                          "+12125551234",
+		"sip:07912345678;phone-context=+44@example.com;user=phone": "+447912345678",
+		"sip:1234;phone-context=example.com@example.com":           "1234",
+	}
+	for uriStr, expected := range tests {
+		uri := sip.Uri{}
+		if err := sip.ParseUri(uriStr, &uri); err != nil {
+			t.Fatalf("%s: %v", uriStr, err)
+		}
+		if _, got := plan.uriToInternational(uri); got != expected {
+			t.Errorf("%s: expected %s, got %s", uriStr, expected, got)
+		}
+	}
+}
@@ -1,38 +1,240 @@
 package sipspamfilter
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
-func (cfg *spamFilter) parseNumberLists() error {
+// parseNumberLists loads the blacklists and whitelists of all list sets and replaces the indexes in use; the files of the new indexes are added to the status.
+// List sets with the same paths share the index.
+func (cfg *spamFilter) parseNumberLists(status *reloadStatus) error {
 	cfg.parserLock.Lock()
 	defer cfg.parserLock.Unlock()
 
-	newBlacklist, err := cfg.parseNumberList(cfg.config.Spam.BlacklistPaths)
-	if err != nil {
-		return err
+	type setIndexes struct {
+		blacklist *numberIndex
+		whitelist *numberIndex
 	}
-
-	newWhitelist, err := cfg.parseNumberList(cfg.config.Spam.WhitelistPaths)
-	if err != nil {
-		return err
+	sets := cfg.listSets()
+	// announcements, prompts and greetings which cannot be played are reported with the lists, rather than during a call
+	for _, set := range sets {
+		if err := set.checkAnnouncement(cfg.log); err != nil {
+			return err
+		}
+		if err := set.checkChallengePrompts(); err != nil {
+			return err
+		}
+		if err := set.checkVoicemailGreeting(); err != nil {
+			return err
+		}
+	}
+	indexes := make([]setIndexes, len(sets))
+	loaded := make(map[string]*numberIndex) // by list and paths
+	closeLoaded := func() {
+		for _, idx := range loaded {
+			idx.close()
+		}
+	}
+	// the current indexes are only replaced while holding the parser lock, so they can be read without the list locks
+	for i, set := range sets {
+		for _, list := range []struct {
+			name     string
+			paths    []string
+			previous *numberIndex
+			index    **numberIndex
+		}{
+			{"blacklist", set.spam.BlacklistPaths, set.blacklistNumbers, &indexes[i].blacklist},
+			{"whitelist", set.spam.WhitelistPaths, set.whitelistNumbers, &indexes[i].whitelist},
+		} {
+			key := list.name + "\n" + strings.Join(list.paths, "\n")
+			if idx, ok := loaded[key]; ok {
+				*list.index = idx
+				continue
+			}
+			idx, err := cfg.loadNumberIndex(set.listName(list.name), localListPaths(cfg.config.Spam.RemoteListCacheDir, list.paths), list.previous)
+			if err != nil {
+				closeLoaded()
+				return err
+			}
+			cfg.reportExpired(set.listName(list.name), idx)
+			loaded[key] = idx
+			*list.index = idx
+		}
+		blacklistIndex, whitelistIndex := indexes[i].blacklist, indexes[i].whitelist
+		cfg.log.Info("Loaded %d %s entries from %d files and %d %s entries from %d files", blacklistIndex.size(), set.listName("blacklist"), len(blacklistIndex.lists), whitelistIndex.size(), set.listName("whitelist"), len(whitelistIndex.lists))
+		status.setLists(set.listName("blacklist"), blacklistIndex)
+		status.setLists(set.listName("whitelist"), whitelistIndex)
 	}
 
 	cfg.blacklistLock.Lock()
 	cfg.whitelistLock.Lock()
 	defer cfg.blacklistLock.Unlock()
 	defer cfg.whitelistLock.Unlock()
-	cfg.blacklistNumbers = newBlacklist
-	cfg.whitelistNumbers = newWhitelist
+	old := make(map[*numberIndex]string)
+	for i, set := range sets {
+		old[set.blacklistNumbers] = set.listName("blacklist")
+		old[set.whitelistNumbers] = set.listName("whitelist")
+		set.blacklistNumbers = indexes[i].blacklist
+		set.whitelistNumbers = indexes[i].whitelist
+	}
+	for _, idx := range loaded {
+		delete(old, idx)
+	}
+	for idx, name := range old {
+		if err := idx.close(); err != nil {
+			cfg.log.Warn("Error closing previous %s index file: %v", name, err)
+		}
+	}
 
 	return nil
 }
 
-func (cfg *spamFilter) parseNumberList(paths []string) (newList []*numberList, err error) {
+// loadNumberIndex parses the list files and builds the lookup index, reusing the lists of the previous index for unchanged files;
+// in compact mode, the index is loaded from, and saved to, the index file if configured
+func (cfg *spamFilter) loadNumberIndex(name string, paths []string, previous *numberIndex) (*numberIndex, error) {
+	if !cfg.config.Spam.CompactIndex {
+		lists, changes, err := cfg.parseNumberList(name, paths, nil, previous)
+		if err != nil {
+			return nil, err
+		}
+		idx := newNumberIndex(lists)
+		idx.changes = changes
+		return idx, nil
+	}
+
+	indexFile := ""
+	fingerprint := ""
+	if cfg.config.Spam.IndexDir != "" {
+		indexFile = filepath.Join(cfg.config.Spam.IndexDir, name+".idx")
+		var err error
+		fingerprint, err = listsFingerprint(paths)
+		if err != nil {
+			return nil, fmt.Errorf("could not access %s paths: %v", name, err)
+		}
+		fingerprint = cfg.indexSettings() + "\n" + fingerprint
+		compact, err := openCompactIndexFile(indexFile, fingerprint)
+		if err == nil {
+			lists, err := compact.loadLists(cfg.log)
+			if err == nil {
+				cfg.log.Info("Loaded %s from index file %s", name, indexFile)
+				for _, list := range lists {
+					if fileInfo, err := os.Stat(list.fileName); err == nil {
+						list.fileSize, list.modTime = fileInfo.Size(), fileInfo.ModTime()
+					}
+				}
+				idx := newNumberIndex(lists)
+				idx.compact = compact
+				idx.changes = make(map[string]string)
+				for _, list := range lists {
+					idx.changes[list.fileName] = "indexed"
+				}
+				return idx, nil
+			}
+			compact.close()
+		}
+		switch {
+		case errors.Is(err, errCompactIndexOutdated):
+			cfg.log.Info("Not using %s index file %s, parsing list files: %v", name, indexFile, err)
+		case err != nil && !os.IsNotExist(err):
+			cfg.log.Warn("Not using %s index file %s, rebuilding it from the list files: %v", name, indexFile, err)
+		}
+	}
+
+	builder := newCompactIndexBuilder()
+	lists, changes, err := cfg.parseNumberList(name, paths, builder, previous)
+	if err != nil {
+		return nil, err
+	}
+	idx := newNumberIndex(lists)
+	idx.compact = builder.build()
+	idx.changes = changes
+	if indexFile != "" {
+		if err := idx.compact.writeFile(indexFile, fingerprint); err != nil {
+			cfg.log.Warn("Could not write %s index file %s: %v", name, indexFile, err)
+		}
+	}
+	idx.compact.others = nil // only needed for writing the index file
+	return idx, nil
+}
+
+// parseNumberList parses all list files in the paths, reusing the lists of the previous index for files which did not change, and returns
+// how each file changed (added, changed, unchanged or removed); if a compact index builder is given, exact numbers are moved into it as each file is parsed
+func (cfg *spamFilter) parseNumberList(name string, paths []string, builder *compactIndexBuilder, previous *numberIndex) (newList []*numberList, changes map[string]string, err error) {
+	files, err := listFiles(paths)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes = make(map[string]string)
+	previousLists := make(map[string]int)
+	if previous != nil {
+		for i, list := range previous.lists {
+			previousLists[list.fileName] = i
+		}
+	}
+	reused := make(map[uint32]uint32) // file number in the previous compact index -> file number in the new one
+	unchanged := 0
+	for _, filePath := range files {
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not access file %s: %v", filePath, err)
+		}
+		previousIdx, existed := previousLists[filePath]
+		delete(previousLists, filePath)
+		if existed {
+			list := previous.lists[previousIdx]
+			if list.unchanged(fileInfo) {
+				if builder != nil {
+					reused[uint32(previousIdx)] = builder.add(list)
+				}
+				newList = append(newList, list)
+				changes[filePath] = "unchanged"
+				unchanged++
+				continue
+			}
+		}
+
+		bl, err := cfg.parseFile(filePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing file %s: %v", filePath, err)
+		}
+		change := "added"
+		if existed {
+			change = "changed"
+		}
+		changes[filePath] = change
+		if previous != nil {
+			cfg.log.Info("Reloading %s: file %s %s, %d entries", name, filePath, change, bl.size())
+		}
+		if builder != nil {
+			builder.add(bl)
+		}
+		newList = append(newList, bl)
+	}
+	if previous != nil {
+		for filePath := range previousLists {
+			cfg.log.Info("Reloading %s: file %s removed", name, filePath)
+			changes[filePath] = "removed"
+		}
+		cfg.log.Info("Reloading %s: %d of %d files unchanged", name, unchanged, len(files))
+	}
+	if builder != nil && len(reused) > 0 && previous.compact != nil {
+		builder.copyEntries(previous.compact, reused)
+	}
+
+	return newList, changes, nil
+}
+
+// listFiles returns the list files in the paths; directories are walked recursively
+func listFiles(paths []string) (files []string, err error) {
 	for _, path := range paths {
 		fileInfo, err := os.Stat(path)
 		if err != nil {
@@ -41,17 +243,8 @@ func (cfg *spamFilter) parseNumberList(paths []string) (newList []*numberList, e
 
 		if fileInfo.IsDir() {
 			// Handle directory
-			err := filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if !info.IsDir() {
-					bl, err := cfg.parseFile(filePath)
-					if err != nil {
-						return fmt.Errorf("error parsing file %s: %v", filePath, err)
-					}
-					newList = append(newList, bl)
-				}
+			err := walkListFiles(path, func(filePath string, info os.FileInfo) error {
+				files = append(files, filePath)
 				return nil
 			})
 			if err != nil {
@@ -59,69 +252,280 @@ func (cfg *spamFilter) parseNumberList(paths []string) (newList []*numberList, e
 			}
 		} else {
 			// Handle single file
-			bl, err := cfg.parseFile(path)
-			if err != nil {
-				return nil, fmt.Errorf("error parsing file %s: %v", path, err)
-			}
-			newList = append(newList, bl)
+			files = append(files, path)
 		}
 	}
 
-	return newList, nil
+	return files, nil
+}
+
+// reportExpired logs the number of expired entries in each list file, which are ignored until they are pruned
+func (cfg *spamFilter) reportExpired(name string, idx *numberIndex) {
+	expired := idx.expiredEntries(time.Now())
+	files := []string{}
+	for file := range expired {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		cfg.log.Warn("Ignoring %d expired %s entries in file %s, use the prune command to remove them", expired[file], name, file)
+	}
 }
 
 // Helper function to parse individual files
 func (cfg *spamFilter) parseFile(filePath string) (*numberList, error) {
-	log := cfg.log.WithPrefix(fmt.Sprintf("parseFile: %s: ", filePath))
+	problems := &listProblems{
+		log:    cfg.log.WithPrefix("parseFile: "),
+		strict: cfg.config.Spam.StrictValidation,
+	}
+	newList, err := parseListFile(filePath, problems)
+	if err != nil {
+		return nil, err
+	}
+	if invalid := problems.invalidEntries(); problems.strict && len(invalid) > 0 {
+		return nil, fmt.Errorf("strict validation failed, %d invalid entries found, first invalid entry: %s", len(invalid), invalid[0])
+	}
+	return newList, nil
+}
+
+// parseListFile parses a list file; problems with entries are added to problems, and the entries are skipped, or loaded as written if they are not in E.164 format
+func parseListFile(filePath string, problems *listProblems) (*numberList, error) {
 	newList := &numberList{
 		fileName: filePath,
-		numbers:  make(map[string]number),
 	}
-	file, err := os.Open(filePath)
+	seen := make(map[string]int) // number or prefix -> line number, to detect duplicates
+
+	// record the state of the file before reading it, so that a change while reading is detected on the next reload
+	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	newList.fileSize, newList.modTime = fileInfo.Size(), fileInfo.ModTime()
+	hash := sha256.New()
 
-	scanner := bufio.NewScanner(file)
-	lineNo := 0
-	for scanner.Scan() {
-		lineNo++
-		line := strings.TrimSpace(scanner.Text())
-
-		// Skip empty lines and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	fileDefaults := ""
+	attributes := make(map[string]*entryAttributes) // deduplicated attributes, as many entries share the file defaults
+	announcements := make(map[string]error)         // checked announcement files
+	// an announcement which cannot be played fails the load, the same way as the announcement of the spam settings
+	checkAnnouncement := func(attrs *entryAttributes, lineNo int) error {
+		if attrs == nil || attrs.announcement == "" {
+			return nil
 		}
-
-		// Strip comments from the line
-		lineSplit := strings.Split(line, "#")
-		line = strings.TrimRight(strings.TrimSpace(lineSplit[0]), "\n\r")
-		if line == "" {
-			continue
+		err, ok := announcements[attrs.announcement]
+		if !ok {
+			_, err = checkWavFile(attrs.announcement)
+			announcements[attrs.announcement] = err
 		}
-		comment := ""
-		if len(lineSplit) > 1 {
-			comment = strings.TrimRight(strings.TrimSpace(lineSplit[1]), "\n\r")
+		if err != nil {
+			return fmt.Errorf("invalid announcement on line %d: %v", lineNo, err)
+		}
+		return nil
+	}
+	err = readListFile(filePath, hash, func(lineNo int, line listLine) error {
+		// File default attributes apply to all entries which follow
+		if line.defaults {
+			defaults, warnings := parseEntryAttributes(line.attributes)
+			for _, warning := range warnings {
+				problems.add(filePath, lineNo, "file defaults: %s", warning)
+			}
+			if err := checkAnnouncement(defaults, lineNo); err != nil {
+				return err
+			}
+			fileDefaults = ""
+			if defaults != nil {
+				fileDefaults = defaults.raw
+			}
+			return nil
 		}
 
-		// Check if number starts with +
-		if !strings.HasPrefix(line, "+") {
-			log.Warn("Number in file %s line %d does not start with +: %s", filePath, lineNo, line)
+		if line.attributes == "" && strings.Contains(line.entry, "=") && !strings.HasSuffix(filePath, ".regex") {
+			problems.add(filePath, lineNo, "no attributes found in %s, attributes must follow the entry as key=value words", line.entry)
+		}
+		if line.attributes != "" {
+			entryAttrs, warnings := parseEntryAttributes(line.attributes)
+			for _, warning := range warnings {
+				problems.add(filePath, lineNo, "%s", warning)
+			}
+			if err := checkAnnouncement(entryAttrs, lineNo); err != nil {
+				return err
+			}
+		}
+		raw := strings.TrimSpace(fileDefaults + " " + line.attributes)
+		attrs, ok := attributes[raw]
+		if !ok {
+			attrs, _ = parseEntryAttributes(raw)
+			attributes[raw] = attrs
 		}
 
-		if val, ok := newList.numbers[line]; ok {
-			log.Warn("Ignoring duplicate number on line number %d (first seen on line %d) in file %s", lineNo, val.lineNumber, filePath)
-		} else {
-			newList.numbers[line] = number{
+		return newList.addEntry(line.entry, lineNo, line.comment, attrs, seen, problems)
+	})
+	if err != nil {
+		return nil, err
+	}
+	newList.hash = hash.Sum(nil)
+	newList.finish(problems)
+	return newList, nil
+}
+
+// unchanged returns true if the file has the same size and modification time as when the list was parsed, or the same content
+func (l *numberList) unchanged(fileInfo os.FileInfo) bool {
+	if fileInfo.Size() == l.fileSize && fileInfo.ModTime().Equal(l.modTime) {
+		return true
+	}
+	if l.hash == nil || fileInfo.Size() != l.fileSize {
+		return false
+	}
+	file, err := os.Open(l.fileName)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil || !bytes.Equal(hash.Sum(nil), l.hash) {
+		return false
+	}
+	// only the modification time changed, for example the file was touched or saved without changes
+	l.modTime = fileInfo.ModTime()
+	return true
+}
+
+// listLine is a list file line, split into its parts
+type listLine struct {
+	entry      string // the number, prefix, range or regex
+	attributes string // the key=value attributes of the entry, or the file defaults
+	comment    string
+	defaults   bool // a "#!" file defaults line
+}
+
+// parseListLine splits a list file line into the entry, the attributes and the comment; returns false for empty and comment lines
+func parseListLine(text string) (line listLine, ok bool) {
+	text = strings.TrimSpace(text)
+
+	// File defaults lines start with #!, and may have a comment
+	if strings.HasPrefix(text, fileDefaultsPrefix) {
+		return listLine{
+			attributes: strings.TrimSpace(strings.Split(strings.TrimPrefix(text, fileDefaultsPrefix), "#")[0]),
+			defaults:   true,
+		}, true
+	}
+
+	// Skip empty lines and comments
+	if text == "" || strings.HasPrefix(text, "#") {
+		return line, false
+	}
+
+	// Strip comments from the line
+	lineSplit := strings.Split(text, "#")
+	text = strings.TrimRight(strings.TrimSpace(lineSplit[0]), "\n\r")
+	if text == "" {
+		return line, false
+	}
+	if len(lineSplit) > 1 {
+		line.comment = strings.TrimRight(strings.TrimSpace(lineSplit[1]), "\n\r")
+	}
+
+	// Attributes follow the entry, separated by spaces: the trailing key=value words are the attributes, and the words before them the entry,
+	// which may contain spaces, such as a number written in groups
+	spans := attributeSpans(text)
+	first := len(spans)
+	for first > 1 && isEntryAttributes(text[spans[first-1][0]:spans[first-1][1]]) {
+		first--
+	}
+	if first == len(spans) {
+		line.entry = text
+		return line, true
+	}
+	line.entry, line.attributes = strings.TrimSpace(text[:spans[first][0]]), text[spans[first][0]:]
+	return line, true
+}
+
+// addEntry adds a single list entry to the list, depending on the entry type (number, prefix, range or regex)
+func (newList *numberList) addEntry(line string, lineNo int, comment string, attributes *entryAttributes, seen map[string]int, problems *listProblems) error {
+	filePath := newList.fileName
+
+	// Regex list files contain one regular expression per line, matched against the whole number
+	if strings.HasSuffix(filePath, ".regex") {
+		regex, err := regexp.Compile("^(?:" + line + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid regex on line %d: %v", lineNo, err)
+		}
+		newList.regexes = append(newList.regexes, numberRegex{
+			regex: regex,
+			entry: number{
+				number:     line,
 				lineNumber: lineNo,
 				comment:    comment,
+				attributes: attributes,
+			},
+		})
+		return nil
+	}
+
+	// Range entries are in the format start-end
+	if isNumberRange(line) {
+		start, end, err := parseNumberRange(line)
+		if err != nil {
+			problems.addInvalid(filePath, lineNo, "ignoring invalid range %s: %v", line, err)
+			return nil
+		}
+		for _, n := range []string{start, end} {
+			if err := validateE164(n, false); err != nil {
+				problems.addInvalid(filePath, lineNo, "range %s: %s: %v", line, n, err)
+				break
 			}
 		}
+		newList.ranges = append(newList.ranges, numberRange{
+			start: start,
+			end:   end,
+			entry: number{
+				number:     start + "-" + end,
+				lineNumber: lineNo,
+				comment:    comment,
+				attributes: attributes,
+			},
+		})
+		return nil
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	// Prefix entries end with a *
+	isPrefix := strings.HasSuffix(line, "*")
+	if isPrefix {
+		prefix := strings.TrimSuffix(line, "*")
+		if prefix == "" || strings.Contains(prefix, "*") {
+			problems.addInvalid(filePath, lineNo, "ignoring invalid prefix %s", line)
+			return nil
+		}
 	}
-	return newList, nil
+	if err := validateE164(strings.TrimSuffix(line, "*"), isPrefix); err != nil {
+		problems.addInvalid(filePath, lineNo, "%s: %v", line, err)
+	}
+
+	if seenLineNo, ok := seen[line]; ok {
+		problems.add(filePath, lineNo, "ignoring duplicate %s, first seen on line %d", line, seenLineNo)
+		return nil
+	}
+	seen[line] = lineNo
+	entry := number{
+		number:     line,
+		lineNumber: lineNo,
+		comment:    comment,
+		attributes: attributes,
+	}
+	if isPrefix {
+		newList.prefixes = append(newList.prefixes, entry)
+	} else {
+		newList.numbers = append(newList.numbers, entry)
+	}
+	return nil
+}
+
+// finish is called once all entries have been added to the list
+func (newList *numberList) finish(problems *listProblems) {
+	newList.ranges = newList.ranges.sortAndCheckOverlaps(func(cur numberRange, previous numberRange, duplicate bool) {
+		if duplicate {
+			problems.add(newList.fileName, cur.entry.lineNumber, "ignoring duplicate range %s-%s, first seen on line %d", cur.start, cur.end, previous.entry.lineNumber)
+			return
+		}
+		problems.add(newList.fileName, cur.entry.lineNumber, "range %s-%s overlaps range %s-%s on line %d", cur.start, cur.end, previous.start, previous.end, previous.entry.lineNumber)
+	})
 }
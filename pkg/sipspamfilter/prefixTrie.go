@@ -0,0 +1,48 @@
+package sipspamfilter
+
+// prefixTrie stores number prefixes (list entries ending with *) and finds the longest prefix matching a caller ID
+type prefixTrie struct {
+	root prefixNode
+	size int
+}
+
+type prefixNode struct {
+	children map[byte]*prefixNode
+	matches  []listMatch
+}
+
+// insert adds a list entry for the prefix to the trie; the same prefix may be added from multiple list files
+func (t *prefixTrie) insert(prefix string, match listMatch) {
+	node := &t.root
+	for i := 0; i < len(prefix); i++ {
+		if node.children == nil {
+			node.children = make(map[byte]*prefixNode)
+		}
+		child, ok := node.children[prefix[i]]
+		if !ok {
+			child = &prefixNode{}
+			node.children[prefix[i]] = child
+		}
+		node = child
+	}
+	node.matches = append(node.matches, match)
+	t.size++
+}
+
+// longestMatch returns the list entries of the longest prefix matching the callerID, and the length of that prefix; prefixes with only
+// expired entries are skipped, so that a shorter prefix matches instead
+func (t *prefixTrie) longestMatch(callerID string) (matches []listMatch, length int) {
+	node := &t.root
+	for i := 0; i < len(callerID); i++ {
+		child, ok := node.children[callerID[i]]
+		if !ok {
+			break
+		}
+		node = child
+		if active := activeMatches(node.matches); active != nil {
+			matches = active
+			length = i + 1
+		}
+	}
+	return matches, length
+}
@@ -0,0 +1,161 @@
+package sipspamfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rglonek/logger"
+)
+
+// Prune removes expired entries from the blacklist and whitelist files; with dryRun, the expired entries are only logged
+func Prune(config *SpamFilterConfig, log *logger.Logger, dryRun bool) error {
+	sets, err := configListSets(config)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	total := 0
+	files, err := listFiles(editableListPaths(listPaths(sets), log))
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool) // a file may be in more than one path
+	for _, file := range files {
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+		removed, err := removeEntries(file, dryRun, func(lineNo int, line listLine, fileDefaults string) bool {
+			return logExpired(log, file, lineNo, line, fileDefaults, now)
+		})
+		if err != nil {
+			return fmt.Errorf("error pruning file %s: %v", file, err)
+		}
+		total += removed
+	}
+	if dryRun {
+		log.Info("Found %d expired entries, no files were changed", total)
+	} else {
+		log.Info("Removed %d expired entries, send SIGUSR1 to reload the lists", total)
+	}
+	return nil
+}
+
+// editableListPaths returns the list paths without the remote lists, which can only be changed at the source
+func editableListPaths(paths []string, log *logger.Logger) []string {
+	local := []string{}
+	for _, p := range paths {
+		if isRemoteList(p) {
+			log.Info("Not changing remote list %s, it can only be changed at the source", p)
+			continue
+		}
+		local = append(local, p)
+	}
+	return local
+}
+
+// removeEntries rewrites a list file without the entries for which remove returns true; text list files keep all other lines as they are,
+// and structured list files are rewritten in the standard layout; with dryRun, the file is not changed
+func removeEntries(filePath string, dryRun bool, remove func(lineNo int, line listLine, fileDefaults string) bool) (removed int, err error) {
+	if listFileFormat(filePath) != "" {
+		return removeRecords(filePath, dryRun, remove)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return 0, err
+	}
+
+	fileDefaults := ""
+	kept := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		text := scanner.Text()
+		line, ok := parseListLine(text)
+		if ok && line.defaults {
+			fileDefaults = line.attributes
+		}
+		if !ok || line.defaults {
+			kept = append(kept, text)
+			continue
+		}
+		if remove(lineNo, line, fileDefaults) {
+			removed++
+			continue
+		}
+		kept = append(kept, text)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if removed == 0 || dryRun {
+		return removed, nil
+	}
+	return removed, replaceFile(filePath, func(w io.Writer) error {
+		_, err := io.WriteString(w, strings.Join(kept, "\n")+"\n")
+		return err
+	})
+}
+
+// removeRecords rewrites a structured list file without the records for which remove returns true
+func removeRecords(filePath string, dryRun bool, remove func(lineNo int, line listLine, fileDefaults string) bool) (removed int, err error) {
+	records, lines, err := readListRecords(filePath)
+	if err != nil {
+		return 0, err
+	}
+	kept := []listRecord{}
+	for i := range records {
+		if remove(lines[i], records[i].listLine(), "") {
+			removed++
+			continue
+		}
+		kept = append(kept, records[i])
+	}
+	if removed == 0 || dryRun {
+		return removed, nil
+	}
+	return removed, replaceFile(filePath, func(w io.Writer) error {
+		return writeListRecords(w, filePath, kept)
+	})
+}
+
+// logExpired logs the entry and returns true if it has expired
+func logExpired(log *logger.Logger, filePath string, lineNo int, line listLine, fileDefaults string, now time.Time) bool {
+	attrs, _ := parseEntryAttributes(fileDefaults + " " + line.attributes)
+	if !attrs.expired(now) {
+		return false
+	}
+	log.Info("Expired entry on line number %d in file %s: %s (expired %s)", lineNo, filePath, line.entry, attrs.expiry().Format(time.RFC3339))
+	return true
+}
+
+// replaceFile writes to a temporary file and renames it, so that a reload never sees a partially written file
+func replaceFile(filePath string, write func(w io.Writer) error) error {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Chmod(fileInfo.Mode().Perm())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
@@ -0,0 +1,160 @@
+package sipspamfilter
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// reloadStatus is the status of the last list reload; it is logged after each reload, and written to the reload status file if configured
+type reloadStatus struct {
+	Reason           string             `json:"reason"`
+	Started          time.Time          `json:"started"`
+	Finished         time.Time          `json:"finished"`
+	Duration         string             `json:"duration"`
+	Coalesced        int                `json:"coalesced_requests"` // requests which arrived while a reload was queued, and were merged into this reload
+	Error            string             `json:"error,omitempty"`
+	LastSuccess      time.Time          `json:"last_success"`
+	Reloads          int                `json:"reloads"`
+	Failures         int                `json:"failures"`
+	BlacklistEntries int                `json:"blacklist_entries"` // entries of the global blacklist
+	WhitelistEntries int                `json:"whitelist_entries"` // entries of the global whitelist
+	Files            []reloadFileStatus `json:"files"`             // the files of the lists in use, which are those of the last successful reload
+}
+
+type reloadFileStatus struct {
+	List    string `json:"list"` // blacklist or whitelist, prefixed with the DID name and a dot for the lists of a DID
+	File    string `json:"file"`
+	Entries int    `json:"entries"`
+	Change  string `json:"change"` // added, changed, unchanged, removed or indexed (loaded from the compact index file)
+}
+
+// setLists replaces the files of the list in the status with the files of the index
+func (s *reloadStatus) setLists(list string, idx *numberIndex) {
+	files := []reloadFileStatus{}
+	for _, f := range s.Files {
+		if f.List != list {
+			files = append(files, f)
+		}
+	}
+	for i, entries := range idx.fileEntries() {
+		fileName := idx.lists[i].fileName
+		files = append(files, reloadFileStatus{List: list, File: fileName, Entries: entries, Change: idx.changes[fileName]})
+	}
+	for fileName, change := range idx.changes {
+		if change == "removed" {
+			files = append(files, reloadFileStatus{List: list, File: fileName, Change: change})
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].List != files[j].List {
+			return files[i].List < files[j].List
+		}
+		return files[i].File < files[j].File
+	})
+	s.Files = files
+	switch list {
+	case "blacklist":
+		s.BlacklistEntries = idx.size()
+	case "whitelist":
+		s.WhitelistEntries = idx.size()
+	}
+}
+
+func (cfg *spamFilter) initReloadQueue() {
+	cfg.reloadRequests = make(chan string, 1)
+	go func() {
+		for reason := range cfg.reloadRequests {
+			cfg.reload(reason)
+		}
+	}()
+}
+
+// requestReload queues a reload of the lists; requests arriving while a reload is queued collapse into it,
+// so that any number of requests arriving while a reload runs result in a single follow-up reload
+func (cfg *spamFilter) requestReload(reason string) {
+	select {
+	case cfg.reloadRequests <- reason:
+		cfg.log.Info("%s: Reload of the lists queued", reason)
+	default:
+		cfg.reloadStatusLock.Lock()
+		cfg.reloadCoalesced++
+		cfg.reloadStatusLock.Unlock()
+		cfg.log.Info("%s: A reload of the lists is already queued, not queueing another one", reason)
+	}
+}
+
+// reload loads the lists and updates the reload status
+func (cfg *spamFilter) reload(reason string) error {
+	cfg.reloadStatusLock.Lock()
+	status := cfg.reloadStatus
+	status.Reason = reason
+	status.Started = time.Now()
+	status.Coalesced = cfg.reloadCoalesced
+	cfg.reloadCoalesced = 0
+	cfg.reloadStatusLock.Unlock()
+
+	cfg.log.Info("%s: Reloading blacklists", reason)
+	err := cfg.parseNumberLists(&status)
+	status.Finished = time.Now()
+	status.Duration = status.Finished.Sub(status.Started).String()
+	status.Reloads++
+	status.Error = ""
+	if err != nil {
+		status.Error = err.Error()
+		status.Failures++
+		cfg.log.Error("%s: Error reloading blacklists after %s, the previous lists remain in use: %v", reason, status.Duration, err)
+	} else {
+		status.LastSuccess = status.Finished
+		cfg.log.Info("%s: Blacklists reloaded in %s, blacklist_entries=%d whitelist_entries=%d files=%d coalesced_requests=%d", reason, status.Duration, status.BlacklistEntries, status.WhitelistEntries, len(status.Files), status.Coalesced)
+		for _, f := range status.Files {
+			cfg.log.Debug("%s: %s file %s: %s, %d entries", reason, f.List, f.File, f.Change, f.Entries)
+		}
+	}
+
+	cfg.reloadStatusLock.Lock()
+	cfg.reloadStatus = status
+	cfg.reloadStatusLock.Unlock()
+	if cfg.config.Spam.ReloadStatusFile != "" {
+		if werr := writeReloadStatus(cfg.config.Spam.ReloadStatusFile, status); werr != nil {
+			cfg.log.Warn("Could not write reload status file %s: %v", cfg.config.Spam.ReloadStatusFile, werr)
+		}
+	}
+	return err
+}
+
+// writeReloadStatus writes the status as JSON to a temporary file and renames it, so that readers never see a partially written file
+func writeReloadStatus(fileName string, status reloadStatus) error {
+	return writeJSONFile(fileName, status)
+}
+
+// writeJSONFile writes v as indented JSON to a temporary file and renames it, so that readers never see a partially written file
+func writeJSONFile(fileName string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fileName, append(data, '\n'))
+}
+
+// writeFileAtomic writes the data to a temporary file next to the file, and renames it over the file, so that the file is never partially written
+func writeFileAtomic(fileName string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
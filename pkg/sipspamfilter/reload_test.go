@@ -0,0 +1,75 @@
+package sipspamfilter
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rglonek/logger"
+)
+
+func TestReloadQueue(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "blacklist.txt"), []byte("+447000000001\n+447000000002\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	statusFile := filepath.Join(t.TempDir(), "status.json")
+	cfg := &spamFilter{
+		config: &SpamFilterConfig{Spam: SpamFilterSpam{BlacklistPaths: []string{dir}, ReloadStatusFile: statusFile}},
+		log:    logger.NewLogger(),
+	}
+	cfg.log.SetLogLevel(logger.ERROR)
+	cfg.lists.spam = &cfg.config.Spam
+	if err := cfg.reload("startup"); err != nil {
+		t.Fatal(err)
+	}
+	cfg.initReloadQueue()
+
+	// hold the parser lock, as if a reload was running, while requests arrive
+	cfg.parserLock.Lock()
+	cfg.requestReload("first")
+	for len(cfg.reloadRequests) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		cfg.requestReload("more")
+	}
+	cfg.parserLock.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cfg.reloadStatusLock.Lock()
+		status := cfg.reloadStatus
+		cfg.reloadStatusLock.Unlock()
+		if status.Reloads == 3 {
+			if status.Reason != "more" || status.Coalesced != 3 {
+				t.Errorf("expected the follow-up reload with 3 coalesced requests, got %s with %d", status.Reason, status.Coalesced)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 reloads, got %d", status.Reloads)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cfg.reloadStatusLock.Lock()
+	if cfg.reloadStatus.Reloads != 3 {
+		t.Errorf("expected 3 reloads, got %d", cfg.reloadStatus.Reloads)
+	}
+	cfg.reloadStatusLock.Unlock()
+
+	data, err := os.ReadFile(statusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := reloadStatus{}
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.BlacklistEntries != 2 || len(status.Files) != 1 || status.Files[0].Entries != 2 || status.Files[0].Change != "unchanged" || status.Error != "" {
+		t.Errorf("unexpected status file %s", data)
+	}
+}
@@ -0,0 +1,223 @@
+package sipspamfilter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// remoteList is a list file subscribed to over HTTP(S); the last good copy is kept in the remote list cache directory and parsed like a local list file
+type remoteList struct {
+	url       string
+	cacheFile string
+	meta      remoteListMeta
+}
+
+// remoteListMeta is stored next to the cached copy, for conditional requests
+type remoteListMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+func isRemoteList(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// remoteListCacheFile returns the cache file of the URL; the file extension of the URL is kept, so that the list format is detected as for local files
+func remoteListCacheFile(cacheDir string, rawURL string) string {
+	name, ext := "list", ""
+	if u, err := url.Parse(rawURL); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		ext = path.Ext(u.Path)
+		name = strings.TrimSuffix(path.Base(u.Path), ext)
+	}
+	sum := sha256.Sum256([]byte(rawURL))
+	return filepath.Join(cacheDir, name+"-"+hex.EncodeToString(sum[:8])+ext)
+}
+
+// localListPaths returns the list paths with remote list URLs replaced by their cache files
+func localListPaths(cacheDir string, paths []string) []string {
+	local := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if isRemoteList(p) {
+			p = remoteListCacheFile(cacheDir, p)
+		}
+		local = append(local, p)
+	}
+	return local
+}
+
+// initRemoteLists fetches the remote lists once, falling back to the cached copies if a list cannot be fetched; startRemoteListRefresh
+// refreshes them afterwards
+func (cfg *spamFilter) initRemoteLists() error {
+	for _, p := range listPaths(cfg.listSets()) {
+		if !isRemoteList(p) {
+			continue
+		}
+		if cfg.config.Spam.RemoteListCacheDir == "" {
+			return fmt.Errorf("remote_list_cache_dir must be set to use remote list %s", p)
+		}
+		r := &remoteList{
+			url:       p,
+			cacheFile: remoteListCacheFile(cfg.config.Spam.RemoteListCacheDir, p),
+		}
+		cfg.remoteLists = append(cfg.remoteLists, r)
+	}
+	if len(cfg.remoteLists) == 0 {
+		return nil
+	}
+	if cfg.config.Spam.RemoteListMaxSizeMB <= 0 {
+		return fmt.Errorf("remote_list_max_size_mb must be greater than 0")
+	}
+	if err := os.MkdirAll(cfg.config.Spam.RemoteListCacheDir, 0755); err != nil {
+		return fmt.Errorf("could not create remote list cache directory: %v", err)
+	}
+
+	client := &http.Client{Timeout: cfg.config.Spam.RemoteListTimeout.ToDuration()}
+	maxSize := cfg.config.Spam.RemoteListMaxSizeMB * 1024 * 1024
+	for _, r := range cfg.remoteLists {
+		r.loadMeta()
+		if _, err := r.fetch(client, cfg.config.SIP.UserAgent, maxSize, cfg.validateRemoteList); err != nil {
+			if _, serr := os.Stat(r.cacheFile); serr != nil {
+				return fmt.Errorf("could not fetch remote list %s, and there is no cached copy: %v", r.url, err)
+			}
+			cfg.log.Warn("Could not fetch remote list %s, using the cached copy fetched %s: %v", r.url, r.meta.Fetched.Format(time.RFC3339), err)
+		}
+	}
+	return nil
+}
+
+// startRemoteListRefresh refetches the remote lists every remote_list_interval, and queues a reload when one changed; it is started after
+// the reload queue, so that no change is lost
+func (cfg *spamFilter) startRemoteListRefresh() {
+	if len(cfg.remoteLists) == 0 {
+		return
+	}
+	client := &http.Client{Timeout: cfg.config.Spam.RemoteListTimeout.ToDuration()}
+	maxSize := cfg.config.Spam.RemoteListMaxSizeMB * 1024 * 1024
+	go func() {
+		for {
+			time.Sleep(cfg.config.Spam.RemoteListInterval.ToDuration())
+			for _, r := range cfg.remoteLists {
+				changed, err := r.fetch(client, cfg.config.SIP.UserAgent, maxSize, cfg.validateRemoteList)
+				if err != nil && !changed {
+					cfg.log.Warn("Could not refresh remote list %s, keeping the last good copy fetched %s: %v", r.url, r.meta.Fetched.Format(time.RFC3339), err)
+					continue
+				}
+				if err != nil {
+					cfg.log.Warn("Remote list %s refreshed, but: %v", r.url, err)
+				}
+				if changed {
+					cfg.requestReload("Remote list " + r.url + " changed")
+				}
+			}
+		}
+	}()
+}
+
+// validateRemoteList parses a downloaded remote list before it replaces the cached copy
+func (cfg *spamFilter) validateRemoteList(filePath string) error {
+	problems := &listProblems{}
+	if _, err := parseListFile(filePath, problems); err != nil {
+		return err
+	}
+	if invalid := problems.invalidEntries(); cfg.config.Spam.StrictValidation && len(invalid) > 0 {
+		return fmt.Errorf("strict validation failed, %d invalid entries found, first invalid entry: %s", len(invalid), invalid[0].message)
+	}
+	return nil
+}
+
+func (r *remoteList) loadMeta() {
+	data, err := os.ReadFile(r.cacheFile + ".meta")
+	if err != nil {
+		return
+	}
+	meta := remoteListMeta{}
+	if json.Unmarshal(data, &meta) == nil && meta.URL == r.url {
+		r.meta = meta
+	}
+}
+
+// fetch downloads the list if it changed since the last fetch, and replaces the cached copy if the new list can be parsed and is at most
+// maxSize bytes; returns true if the cached copy was replaced
+func (r *remoteList) fetch(client *http.Client, userAgent string, maxSize int64, validate func(filePath string) error) (changed bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	if _, err := os.Stat(r.cacheFile); err == nil {
+		if r.meta.ETag != "" {
+			req.Header.Set("If-None-Match", r.meta.ETag)
+		}
+		if r.meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", r.meta.LastModified)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+
+	// download next to the cached copy, with the same extension so that the format is detected when validating
+	tmp, err := os.CreateTemp(filepath.Dir(r.cacheFile), "."+filepath.Base(r.cacheFile)+".*"+filepath.Ext(r.cacheFile))
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	// a list larger than the maximum size is not downloaded further, so that a misbehaving server cannot fill the disk
+	size, err := io.Copy(tmp, io.LimitReader(resp.Body, maxSize+1))
+	if err == nil && size > maxSize {
+		err = fmt.Errorf("the list is larger than the maximum size of %d bytes", maxSize)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := validate(tmp.Name()); err != nil {
+		return false, fmt.Errorf("downloaded list is invalid: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), r.cacheFile); err != nil {
+		return false, err
+	}
+
+	r.meta = remoteListMeta{
+		URL:          r.url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now(),
+	}
+	data, err := json.MarshalIndent(r.meta, "", "  ")
+	if err == nil {
+		err = os.WriteFile(r.cacheFile+".meta", append(data, '\n'), 0644)
+	}
+	if err != nil {
+		return true, fmt.Errorf("could not write the ETag and modification time, the next refresh downloads the list again: %v", err)
+	}
+	return true, nil
+}
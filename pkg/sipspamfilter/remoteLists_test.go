@@ -0,0 +1,113 @@
+package sipspamfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rglonek/logger"
+)
+
+func TestRemoteLists(t *testing.T) {
+	var lock sync.Mutex
+	body, etag, status, conditional := `\+447000000001`+"\n", `"v1"`, http.StatusOK, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	set := func(newBody string, newETag string, newStatus int) {
+		lock.Lock()
+		body, etag, status = newBody, newETag, newStatus
+		lock.Unlock()
+	}
+
+	url := server.URL + "/lists/shared.regex"
+	cacheDir := t.TempDir()
+	newFilter := func() *spamFilter {
+		cfg := &spamFilter{
+			config: &SpamFilterConfig{Spam: SpamFilterSpam{BlacklistPaths: []string{url}, RemoteListCacheDir: cacheDir}},
+			log:    logger.NewLogger(),
+		}
+		cfg.config.Spam.RemoteListInterval = timeDuration(time.Hour)
+		cfg.config.Spam.RemoteListMaxSizeMB = 1
+		cfg.log.SetLogLevel(logger.CRITICAL)
+		cfg.lists.spam = &cfg.config.Spam
+		return cfg
+	}
+	cfg := newFilter()
+	if err := cfg.initRemoteLists(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.reload("startup"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.lists.blacklistNumbers.lookup("+447000000001")) != 1 {
+		t.Fatal("expected the remote list to be loaded")
+	}
+
+	r := cfg.remoteLists[0]
+	client := &http.Client{}
+	if changed, err := r.fetch(client, "", 1024, cfg.validateRemoteList); err != nil || changed || conditional != 1 {
+		t.Errorf("expected a conditional request for the unchanged list, got changed=%t err=%v conditional=%d", changed, err, conditional)
+	}
+
+	// an invalid list is not used, the last good copy is kept
+	set("+44(\n", `"v2"`, http.StatusOK)
+	if changed, err := r.fetch(client, "", 1024, cfg.validateRemoteList); err == nil || changed {
+		t.Errorf("expected the invalid list to be rejected, got changed=%t err=%v", changed, err)
+	}
+	set(`\+447000000002`+"\n", `"v3"`, http.StatusOK)
+	if changed, err := r.fetch(client, "", 1024, cfg.validateRemoteList); err != nil || !changed {
+		t.Errorf("expected the changed list to be fetched, got changed=%t err=%v", changed, err)
+	}
+	if err := cfg.reload("test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.lists.blacklistNumbers.lookup("+447000000002")) != 1 {
+		t.Error("expected the changed remote list to be loaded")
+	}
+
+	// a list larger than the maximum size is not used, the last good copy is kept
+	set(strings.Repeat("+447000000003\n", 100), `"v4"`, http.StatusOK)
+	if changed, err := r.fetch(client, "", 1024, cfg.validateRemoteList); err == nil || changed {
+		t.Errorf("expected the list larger than the maximum size to be rejected, got changed=%t err=%v", changed, err)
+	}
+	if data, err := os.ReadFile(r.cacheFile); err != nil || !strings.Contains(string(data), "+447000000002") {
+		t.Errorf("expected the cached copy to be kept, got %q, %v", data, err)
+	}
+
+	// startup works with the cached copy if the server is not available
+	set("", "", http.StatusInternalServerError)
+	cfg = newFilter()
+	if err := cfg.initRemoteLists(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.reload("startup"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.lists.blacklistNumbers.lookup("+447000000002")) != 1 {
+		t.Error("expected the cached copy to be loaded")
+	}
+
+	// without a cached copy, startup fails
+	os.RemoveAll(cacheDir)
+	if err := newFilter().initRemoteLists(); err == nil {
+		t.Error("expected startup to fail without a cached copy")
+	}
+}
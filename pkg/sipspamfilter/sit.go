@@ -0,0 +1,82 @@
+package sipspamfilter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/rglonek/diago"
+	"github.com/rglonek/diago/audio"
+	"github.com/rglonek/diago/media"
+	"github.com/rglonek/logger"
+)
+
+// sitSegments are the Special Information Tone sequence for "intercept" (number changed or not in service), as specified in ANSI T1.401:
+// three tones at the low frequencies, short, short, long
+var sitSegments = []struct {
+	frequency float64
+	duration  time.Duration
+}{
+	{913.8, 274 * time.Millisecond},
+	{1370.6, 274 * time.Millisecond},
+	{1776.7, 380 * time.Millisecond},
+}
+
+// sitAmplitude is the amplitude of the tones, about -13 dBm0 for G.711
+const sitAmplitude = 6000
+
+// sitTone returns the SIT sequence as 16 bit little endian mono PCM at the sample rate, padded with silence to a multiple of frameSize bytes
+func sitTone(sampleRate int, frameSize int) []byte {
+	pcm := []byte{}
+	for _, segment := range sitSegments {
+		samples := int(segment.duration.Seconds() * float64(sampleRate))
+		for i := 0; i < samples; i++ {
+			sample := int16(sitAmplitude * math.Sin(2*math.Pi*segment.frequency*float64(i)/float64(sampleRate)))
+			pcm = binary.LittleEndian.AppendUint16(pcm, uint16(sample))
+		}
+	}
+	if rest := len(pcm) % frameSize; rest != 0 {
+		pcm = append(pcm, make([]byte, frameSize-rest)...)
+	}
+	return pcm
+}
+
+// writeSIT encodes the SIT sequence with the codec of the payload type, PCMU or PCMA, and writes it to w in frames of the codec
+func writeSIT(w io.Writer, payloadType uint8) error {
+	codec, err := media.CodecAudioFromPayloadType(payloadType)
+	if err != nil {
+		return err
+	}
+	if payloadType != audio.FORMAT_TYPE_ULAW && payloadType != audio.FORMAT_TYPE_ALAW {
+		return fmt.Errorf("codec %s is not supported, only PCMU and PCMA", codec.String())
+	}
+	enc, err := audio.NewPCMEncoderWriter(payloadType, w)
+	if err != nil {
+		return err
+	}
+	frameSize := codec.SamplesPCM(16)
+	pcm := sitTone(int(codec.SampleRate), frameSize)
+	for i := 0; i < len(pcm); i += frameSize {
+		if _, err := enc.Write(pcm[i : i+frameSize]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// playSIT plays the SIT sequence to the answered call, through the audio writer of the dialog
+func (cfg *spamFilter) playSIT(log *logger.Logger, inDialog *diago.DialogServerSession) {
+	props := diago.MediaProps{}
+	w, err := inDialog.AudioWriter(diago.WithAudioWriterMediaProps(&props))
+	if err != nil {
+		log.Error("SIT failed: %v", err)
+		return
+	}
+	log.Debug("Playing SIT")
+	// the caller hanging up also ends the tones
+	if err := writeSIT(w, props.Codec.PayloadType); err != nil {
+		log.Warn("SIT stopped: %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+package sipspamfilter
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rglonek/diago/audio"
+)
+
+func TestSIT(t *testing.T) {
+	// 928ms of tones at 8000 Hz, padded to 20ms frames of 160 samples
+	pcm := sitTone(8000, 320)
+	if len(pcm) != 47*320 {
+		t.Errorf("expected 47 frames of PCM, got %d bytes", len(pcm))
+	}
+	for _, payloadType := range []uint8{audio.FORMAT_TYPE_ULAW, audio.FORMAT_TYPE_ALAW} {
+		out := &bytes.Buffer{}
+		if err := writeSIT(out, payloadType); err != nil {
+			t.Fatalf("payload type %d: %v", payloadType, err)
+		}
+		if out.Len() != 47*160 {
+			t.Errorf("payload type %d: expected 47 frames of G.711, got %d bytes", payloadType, out.Len())
+		}
+	}
+	if err := writeSIT(&bytes.Buffer{}, audio.FORMAT_TYPE_OPUS); err == nil {
+		t.Error("expected an error for codecs other than PCMU and PCMA")
+	}
+}
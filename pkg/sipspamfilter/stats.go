@@ -7,34 +7,69 @@ import (
 	"github.com/rglonek/logger"
 )
 
+// stats counts each call once, by its outcome, once the outcome is final
 type stats struct {
-	lock             sync.RWMutex
-	blockedCount     int
-	allowedCount     int
-	whitelistedCount int
-	lookupTotalTime  time.Duration
-	oldCounts        int
+	lock                sync.RWMutex
+	blockedCount        int // on a blacklist, auto blacklisted, or hung up on by the challenge
+	allowedCount        int // on no list, and let through
+	whitelistedCount    int
+	withheldCount       int // the withheld_action applied
+	greylistedCount     int // blocked by greylisting
+	challengedCount     int // failed the challenge; also counted as blocked
+	challengeErrorCount int // hung up on because the challenge prompt could not be played; also counted as blocked
+	lookupCount         int
+	lookupTotalTime     time.Duration
+	oldCounts           int
 }
 
-func (s *stats) addBlocked(lookupTime time.Duration) {
+// addLookup records the time taken by a whitelist or blacklist lookup
+func (s *stats) addLookup(lookupTime time.Duration) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.blockedCount++
+	s.lookupCount++
 	s.lookupTotalTime += lookupTime
 }
 
-func (s *stats) addAllowed(lookupTime time.Duration) {
+func (s *stats) addBlocked() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.blockedCount++
+}
+
+func (s *stats) addAllowed() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	s.allowedCount++
-	s.lookupTotalTime += lookupTime
 }
 
-func (s *stats) addWhitelisted(lookupTime time.Duration) {
+func (s *stats) addWhitelisted() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	s.whitelistedCount++
-	s.lookupTotalTime += lookupTime
+}
+
+func (s *stats) addWithheld() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.withheldCount++
+}
+
+func (s *stats) addGreylisted() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.greylistedCount++
+}
+
+func (s *stats) addChallenged() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.challengedCount++
+}
+
+func (s *stats) addChallengeError() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.challengeErrorCount++
 }
 
 func (s *stats) print(log *logger.Logger) {
@@ -42,8 +77,13 @@ func (s *stats) print(log *logger.Logger) {
 	allowedCount := s.allowedCount
 	blockedCount := s.blockedCount
 	whitelistedCount := s.whitelistedCount
+	withheldCount := s.withheldCount
+	greylistedCount := s.greylistedCount
+	challengedCount := s.challengedCount
+	challengeErrorCount := s.challengeErrorCount
+	lookups := s.lookupCount
 	lookupTotalTime := s.lookupTotalTime
-	total := blockedCount + allowedCount + whitelistedCount
+	total := blockedCount + allowedCount + whitelistedCount + withheldCount + greylistedCount
 	if s.oldCounts == total {
 		s.lock.Unlock()
 		return
@@ -51,8 +91,8 @@ func (s *stats) print(log *logger.Logger) {
 	s.oldCounts = total
 	s.lock.Unlock()
 	avgLookupTime := time.Duration(0)
-	if total > 0 {
-		avgLookupTime = lookupTotalTime / time.Duration(total)
+	if lookups > 0 {
+		avgLookupTime = lookupTotalTime / time.Duration(lookups)
 	}
-	log.Info("Stats: blocked=%d allowed=%d whitelisted=%d averageLookupTime=%s", blockedCount, allowedCount, whitelistedCount, avgLookupTime)
+	log.Info("Stats: blocked=%d allowed=%d whitelisted=%d withheld=%d greylisted=%d challenged=%d challengeErrors=%d averageLookupTime=%s", blockedCount, allowedCount, whitelistedCount, withheldCount, greylistedCount, challengedCount, challengeErrorCount, avgLookupTime)
 }
@@ -0,0 +1,235 @@
+package sipspamfilter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rglonek/diago"
+	"github.com/rglonek/diago/audio"
+	"github.com/rglonek/diago/media"
+	"github.com/rglonek/logger"
+)
+
+// voicemailCleanupInterval is how often recordings older than the voicemail retention are deleted
+const voicemailCleanupInterval = time.Hour
+
+// voicemailUnsafeChars are the characters replaced in the caller ID and Call-ID of recording file names
+var voicemailUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9+._@-]`)
+
+type voicemailSettings struct {
+	dir         string // empty if voicemail is not configured, the call is hung up instead
+	greeting    string // WAV file played before recording; empty for no greeting
+	maxDuration time.Duration
+}
+
+// voicemail returns the voicemail settings of the list set
+func (s *listSet) voicemail() voicemailSettings {
+	return voicemailSettings{
+		dir:         s.spam.VoicemailDir,
+		greeting:    s.spam.VoicemailGreeting,
+		maxDuration: s.spam.VoicemailMaxDuration.ToDuration(),
+	}
+}
+
+// initVoicemail validates the voicemail settings, and creates the voicemail directory if it does not exist
+func initVoicemail(spam *SpamFilterSpam) error {
+	if spam.VoicemailDir == "" {
+		if spam.BlockAction == "voicemail" || spam.ChallengeVoicemail {
+			return fmt.Errorf("voicemail_dir must be set if block_action is voicemail or challenge_voicemail is enabled")
+		}
+		return nil
+	}
+	if spam.VoicemailMaxDuration <= 0 {
+		return fmt.Errorf("voicemail_max_duration must be greater than 0")
+	}
+	if spam.VoicemailRetention != "" {
+		if _, err := parseTTL(spam.VoicemailRetention); err != nil {
+			return fmt.Errorf("invalid voicemail_retention: %v", err)
+		}
+	}
+	if err := os.MkdirAll(spam.VoicemailDir, 0755); err != nil {
+		return fmt.Errorf("could not create voicemail_dir: %v", err)
+	}
+	return nil
+}
+
+// checkVoicemailGreeting checks the voicemail greeting of the list set, if any
+func (s *listSet) checkVoicemailGreeting() error {
+	if s.spam.VoicemailDir == "" || s.spam.VoicemailGreeting == "" {
+		return nil
+	}
+	if _, err := checkWavFile(s.spam.VoicemailGreeting); err != nil {
+		return fmt.Errorf("%s voicemail greeting: %v", s.listName("blacklist"), err)
+	}
+	return nil
+}
+
+// voicemailFileName returns the file name of a recording: the caller ID, the start of the recording in UTC and the Call-ID
+func voicemailFileName(callerID string, callID string, start time.Time) string {
+	if callerID == "" {
+		callerID = "withheld"
+	}
+	if callID == "" {
+		callID = "unknown"
+	}
+	name := strings.Join([]string{callerID, start.UTC().Format("20060102T150405Z"), callID}, "_")
+	return voicemailUnsafeChars.ReplaceAllString(name, "_") + ".wav"
+}
+
+// recordVoicemail plays the greeting, if any, to the answered call, and records the caller to a WAV file in the voicemail directory,
+// until the caller hangs up or the maximum duration has passed since the greeting ended; the call is closed when the recording ends
+func (cfg *spamFilter) recordVoicemail(log *logger.Logger, inDialog *diago.DialogServerSession, vm voicemailSettings, callerID string) {
+	if vm.dir == "" {
+		log.Warn("Voicemail: voicemail_dir is not set, hanging up")
+		return
+	}
+	// the greeting has its own limit, so that a long greeting does not use up the recording time
+	if vm.greeting != "" {
+		cfg.playAnnouncement(log, inDialog, vm.greeting, vm.maxDuration)
+	}
+	start := time.Now()
+	// the caller hanging up ends the dialog; closing the call closes the media, which ends the reading
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-inDialog.Context().Done():
+		case <-time.After(vm.maxDuration):
+			log.Debug("Voicemail reached the maximum duration")
+		case <-done:
+			return
+		}
+		inDialog.Close()
+	}()
+
+	props := diago.MediaProps{}
+	r, err := inDialog.AudioReader(diago.WithAudioReaderMediaProps(&props))
+	if err != nil {
+		log.Error("Voicemail failed: %v", err)
+		return
+	}
+	callID := ""
+	if h := inDialog.InviteRequest.CallID(); h != nil {
+		callID = h.Value()
+	}
+	fileName := filepath.Join(vm.dir, voicemailFileName(callerID, callID, start))
+	log.Debug("Recording voicemail to %s", fileName)
+	duration, err := writeVoicemail(fileName, r, props.Codec)
+	if err != nil {
+		log.Error("Voicemail failed: %v", err)
+		return
+	}
+	if duration == 0 {
+		log.Info("Voicemail: the caller left no message")
+		return
+	}
+	log.Info("Voicemail recorded file=%s duration=%s", fileName, duration)
+}
+
+// writeVoicemail decodes the PCMU or PCMA audio read from r, and writes it to the WAV file until reading fails; returns the duration of
+// the recording; the file is removed if no audio was read
+func writeVoicemail(fileName string, r io.Reader, codec media.Codec) (time.Duration, error) {
+	if codec.PayloadType != audio.FORMAT_TYPE_ULAW && codec.PayloadType != audio.FORMAT_TYPE_ALAW {
+		return 0, fmt.Errorf("codec %s is not supported, only PCMU and PCMA", codec.String())
+	}
+	dec, err := audio.NewPCMDecoderReader(codec.PayloadType, r)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return 0, err
+	}
+	wav := audio.NewWavWriter(file)
+	wav.SampleRate = int(codec.SampleRate)
+	wav.NumChans = codec.NumChannels
+	size := 0
+	// the decoder reads one RTP packet per call, which decodes to twice its size
+	buf := make([]byte, 2*media.RTPBufSize)
+	for {
+		n, err := dec.Read(buf)
+		if n > 0 {
+			if _, werr := wav.Write(buf[:n]); werr != nil {
+				file.Close()
+				return 0, werr
+			}
+			size += n
+		}
+		if err != nil {
+			break
+		}
+	}
+	if size == 0 {
+		file.Close()
+		return 0, os.Remove(fileName)
+	}
+	err = wav.Close()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return time.Duration(size) * time.Second / time.Duration(int(codec.SampleRate)*2*codec.NumChannels), err
+}
+
+// initVoicemailRetention deletes recordings older than the voicemail retention of their list set, on startup and then periodically
+func (cfg *spamFilter) initVoicemailRetention() {
+	retention := make(map[string]time.Duration) // by directory; the shortest retention applies to a directory shared by list sets
+	for _, set := range cfg.listSets() {
+		if set.spam.VoicemailDir == "" || set.spam.VoicemailRetention == "" {
+			continue
+		}
+		ttl, _ := parseTTL(set.spam.VoicemailRetention) // validated on startup
+		if current, ok := retention[set.spam.VoicemailDir]; !ok || ttl < current {
+			retention[set.spam.VoicemailDir] = ttl
+		}
+	}
+	if len(retention) == 0 {
+		return
+	}
+	cleanup := func() {
+		for dir, ttl := range retention {
+			deleted, err := deleteOldVoicemails(dir, ttl, time.Now())
+			if err != nil {
+				cfg.log.Warn("Voicemail retention: %v", err)
+			}
+			if deleted > 0 {
+				cfg.log.Info("Voicemail retention: deleted %d recordings older than %s from %s", deleted, ttl, dir)
+			}
+		}
+	}
+	cleanup()
+	go func() {
+		for {
+			time.Sleep(voicemailCleanupInterval)
+			cleanup()
+		}
+	}()
+}
+
+// deleteOldVoicemails deletes the recordings in the directory which were last modified longer than retention ago; returns the number of
+// recordings deleted
+func deleteOldVoicemails(dir string, retention time.Duration, now time.Time) (deleted int, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || filepath.Ext(entry.Name()) != ".wav" {
+			continue
+		}
+		info, ierr := entry.Info()
+		if ierr != nil || now.Sub(info.ModTime()) < retention {
+			continue
+		}
+		if rerr := os.Remove(filepath.Join(dir, entry.Name())); rerr != nil {
+			err = rerr
+			continue
+		}
+		deleted++
+	}
+	return deleted, err
+}
@@ -0,0 +1,100 @@
+package sipspamfilter
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/creasty/defaults"
+	"github.com/rglonek/diago/media"
+)
+
+// packetReader returns one packet per read, like the RTP audio reader of a call
+type packetReader struct {
+	packets [][]byte
+}
+
+func (r *packetReader) Read(b []byte) (int, error) {
+	if len(r.packets) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, r.packets[0])
+	r.packets = r.packets[1:]
+	return n, nil
+}
+
+func TestVoicemail(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2025, 3, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600))
+	if name := voicemailFileName("+447000000001", "a84b4c76e6/6@pc33.example.com", start); name != "+447000000001_20250301T113000Z_a84b4c76e6_6@pc33.example.com.wav" {
+		t.Errorf("unexpected voicemail file name %s", name)
+	}
+
+	// one second of PCMU, in 20ms packets
+	fileName := filepath.Join(dir, "message.wav")
+	r := &packetReader{}
+	for i := 0; i < 50; i++ {
+		r.packets = append(r.packets, bytes.Repeat([]byte{0xff}, 160))
+	}
+	duration, err := writeVoicemail(fileName, r, media.CodecAudioUlaw)
+	if err != nil || duration != time.Second {
+		t.Fatalf("expected a recording of 1s, got %s, %v", duration, err)
+	}
+	if duration, err := checkWavFile(fileName); err != nil || duration != time.Second {
+		t.Errorf("expected a playable WAV file of 1s, got %s, %v", duration, err)
+	}
+
+	// a caller hanging up before speaking leaves no file
+	empty := filepath.Join(dir, "empty.wav")
+	if duration, err := writeVoicemail(empty, &packetReader{}, media.CodecAudioAlaw); err != nil || duration != 0 {
+		t.Errorf("expected an empty recording, got %s, %v", duration, err)
+	}
+	if _, err := os.Stat(empty); !os.IsNotExist(err) {
+		t.Errorf("expected the empty recording to be removed, got %v", err)
+	}
+
+	// recordings older than the retention are deleted, other files are kept
+	old := filepath.Join(dir, "old.wav")
+	notes := filepath.Join(dir, "notes.txt")
+	for _, name := range []string{old, notes} {
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, start, start); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if deleted, err := deleteOldVoicemails(dir, 24*time.Hour, time.Now()); err != nil || deleted != 1 {
+		t.Errorf("expected 1 recording to be deleted, got %d, %v", deleted, err)
+	}
+	for name, exists := range map[string]bool{fileName: true, old: false, notes: true} {
+		if _, err := os.Stat(name); (err == nil) != exists {
+			t.Errorf("expected %s to exist: %v, got %v", name, exists, err)
+		}
+	}
+
+	config := &SpamFilterConfig{}
+	if err := defaults.Set(config); err != nil {
+		t.Fatal(err)
+	}
+	spam := config.Spam
+	spam.BlockAction = "voicemail"
+	if err := initVoicemail(&spam); err == nil {
+		t.Error("expected the voicemail block action to require voicemail_dir")
+	}
+	spam.VoicemailDir = filepath.Join(dir, "voicemail")
+	spam.VoicemailRetention = "forever"
+	if err := initVoicemail(&spam); err == nil {
+		t.Error("expected an invalid voicemail_retention to fail")
+	}
+	spam.VoicemailRetention = "90d"
+	if err := initVoicemail(&spam); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(spam.VoicemailDir); err != nil {
+		t.Errorf("expected the voicemail directory to be created: %v", err)
+	}
+}